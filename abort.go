@@ -0,0 +1,31 @@
+package safetyfast
+
+// The following bits describe why a transaction aborted.
+// They match the abort status bits Intel RTM reports after an abort.
+const (
+	// AbortExplicit is set when the transaction was aborted by XABORT.
+	// The code given to XABORT can be retrieved using AbortCode.
+	AbortExplicit uint32 = 1 << 0
+	// AbortRetry is set when the transaction may succeed on a retry.
+	AbortRetry uint32 = 1 << 1
+	// AbortConflict is set when another logical processor conflicted with
+	// a memory address that was part of the transaction.
+	AbortConflict uint32 = 1 << 2
+	// AbortCapacity is set when an internal buffer overflowed, which
+	// usually means the transaction touched too many memory locations.
+	AbortCapacity uint32 = 1 << 3
+	// AbortDebug is set when a debug breakpoint was hit.
+	AbortDebug uint32 = 1 << 4
+	// AbortNested is set when the abort occurred during a nested transaction.
+	AbortNested uint32 = 1 << 5
+)
+
+// lockedAbortCode is the XABORT code used when a transaction finds the
+// fallback lock held.
+const lockedAbortCode = 0xFF
+
+// AbortCode returns the code that was passed to XABORT, if the AbortExplicit
+// bit is set in status.
+func AbortCode(status uint32) uint8 {
+	return uint8(status >> 24)
+}
@@ -0,0 +1,146 @@
+package safetyfast
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// AdaptiveMutex is a sync.Mutex replacement that spins briefly, and then
+// parks the waiting goroutine until the lock is handed over.
+//
+// Lock spins for one round of LockAttempts using HLE, like SpinHLEMutex,
+// so uncontended and short critical sections cost as much as a spin lock
+// and can be elided. Waiters that do not get the lock within the round are
+// parked, instead of spinning and yielding in an endless loop, so long
+// critical sections and descheduled holders do not burn CPUs. Unlock hands
+// the lock over to a parked waiter, unless another goroutine acquired it
+// first.
+// The zero value is an unlocked mutex. An AdaptiveMutex must not be copied
+// after first use.
+type AdaptiveMutex struct {
+	// lock is 1 while the lock is held or being handed over
+	lock int32
+	// waiters is the number of parked waiters that were not handed the
+	// lock yet
+	waiters int32
+	// sema points to the channel that parked waiters receive the lock
+	// from. It is created by the first waiter.
+	sema unsafe.Pointer
+}
+
+// semaphore returns the channel that hands the lock over to parked
+// waiters, creating it if needed.
+func (m *AdaptiveMutex) semaphore() chan struct{} {
+	p := atomic.LoadPointer(&m.sema)
+	if p == nil {
+		// A single slot suffices, since the lock is only handed over
+		// once the previous handover was received
+		ch := make(chan struct{}, 1)
+		atomic.CompareAndSwapPointer(&m.sema, nil, unsafe.Pointer(&ch))
+		p = atomic.LoadPointer(&m.sema)
+	}
+	return *(*chan struct{})(p)
+}
+
+func (m *AdaptiveMutex) spinRound() bool {
+	var attempts int32 = LockAttempts
+	HLESpinCountLock(&m.lock, &attempts)
+	return attempts > 0
+}
+
+func (m *AdaptiveMutex) Lock() {
+	if m.spinRound() {
+		return
+	}
+	m.lockSlow(nil)
+}
+
+// lockSlow parks the caller until the lock is handed over, or until done
+// is closed. It reports if the lock was acquired.
+func (m *AdaptiveMutex) lockSlow(done <-chan struct{}) bool {
+	sema := m.semaphore()
+	atomic.AddInt32(&m.waiters, 1)
+	// Try again after announcing the waiter, since the holder may have
+	// released the lock before it could see the waiter
+	if atomic.CompareAndSwapInt32(&m.lock, 0, 1) {
+		atomic.AddInt32(&m.waiters, -1)
+		return true
+	}
+	select {
+	case <-sema:
+		return true
+	case <-done:
+	}
+	// Withdraw the waiter, unless all waiters were already handed the
+	// lock, in which case one handover is on its way to this waiter
+	for {
+		n := atomic.LoadInt32(&m.waiters)
+		if n == 0 {
+			<-sema
+			m.Unlock()
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&m.waiters, n, n-1) {
+			return false
+		}
+	}
+}
+
+// TryLock tries to acquire the lock once, without waiting, and reports if
+// it succeeded.
+func (m *AdaptiveMutex) TryLock() bool {
+	// Only start eliding when the lock appears free, like HLESpinCountLock
+	return atomic.LoadInt32(&m.lock) == 0 && HLETryLock(&m.lock) == 0
+}
+
+// LockTimeout acquires the lock, unless it could not be acquired within d.
+// It reports if the lock was acquired. The caller is parked while waiting,
+// like with Lock.
+func (m *AdaptiveMutex) LockTimeout(d time.Duration) bool {
+	if m.spinRound() {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return m.lockSlow(ctx.Done())
+}
+
+// LockContext acquires the lock, unless ctx is done first, in which case
+// it returns the context's error. The caller is parked while waiting, like
+// with Lock.
+func (m *AdaptiveMutex) LockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.spinRound() || m.lockSlow(ctx.Done()) {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// Unlock releases the lock, and hands it over to a parked waiter, if any.
+func (m *AdaptiveMutex) Unlock() {
+	// Release the lock first, which ends an elided section before the
+	// waiters are inspected
+	HLEUnlock(&m.lock)
+	for atomic.LoadInt32(&m.waiters) != 0 {
+		if !atomic.CompareAndSwapInt32(&m.lock, 0, 1) {
+			// The new holder hands the lock over when it releases it
+			return
+		}
+		if n := atomic.LoadInt32(&m.waiters); n != 0 && atomic.CompareAndSwapInt32(&m.waiters, n, n-1) {
+			m.semaphore() <- struct{}{}
+			return
+		}
+		// The waiters gave up in the meantime
+		atomic.StoreInt32(&m.lock, 0)
+	}
+}
+
+// IsLocked reports if the lock is held.
+// When the lock has been elided by HLE, it appears free to other threads.
+func (m *AdaptiveMutex) IsLocked() bool {
+	return atomic.LoadInt32(&m.lock) != 0
+}
@@ -0,0 +1,158 @@
+package safetyfast
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveMutex(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const numIterations = 50000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	var m AdaptiveMutex
+	var wg sync.WaitGroup
+	var counter int
+
+	wg.Add(numConcurGoRoutines)
+	for g := 0; g < numConcurGoRoutines; g++ {
+		go func() {
+			for i := 0; i < numIterations; i++ {
+				m.Lock()
+				counter++
+				m.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if expected := numIterations * numConcurGoRoutines; counter != expected {
+		t.Fatalf("Counter is %d, but we expected %d", counter, expected)
+	}
+	if m.IsLocked() {
+		t.Error("IsLocked reported true after all goroutines unlocked")
+	}
+	if n := atomic.LoadInt32(&m.waiters); n != 0 {
+		t.Errorf("%d waiters remain after all goroutines unlocked", n)
+	}
+}
+
+func TestAdaptiveMutexParks(t *testing.T) {
+	const numWaiters = 4
+
+	var m AdaptiveMutex
+	var wg sync.WaitGroup
+	var counter int
+
+	m.Lock()
+	wg.Add(numWaiters)
+	for i := 0; i < numWaiters; i++ {
+		go func() {
+			m.Lock()
+			counter++
+			m.Unlock()
+			wg.Done()
+		}()
+	}
+	// The waiters park once they spun for a round
+	for atomic.LoadInt32(&m.waiters) != numWaiters {
+		time.Sleep(time.Millisecond)
+	}
+	m.Unlock()
+	wg.Wait()
+
+	if counter != numWaiters {
+		t.Fatalf("Counter is %d, but we expected %d", counter, numWaiters)
+	}
+	if m.IsLocked() {
+		t.Error("IsLocked reported true after all waiters unlocked")
+	}
+}
+
+func TestAdaptiveMutexGiveUp(t *testing.T) {
+	var m AdaptiveMutex
+	m.Lock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gaveUp := make(chan error)
+	go func() {
+		gaveUp <- m.LockContext(ctx)
+	}()
+	for atomic.LoadInt32(&m.waiters) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	locked := make(chan struct{})
+	go func() {
+		m.Lock()
+		close(locked)
+	}()
+	for atomic.LoadInt32(&m.waiters) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-gaveUp; err != context.Canceled {
+		t.Fatalf("LockContext returned %v instead of %v", err, context.Canceled)
+	}
+	m.Unlock()
+	<-locked
+	if !m.IsLocked() {
+		t.Error("IsLocked reported false after the lock was handed over")
+	}
+	m.Unlock()
+	if m.IsLocked() {
+		t.Error("IsLocked reported true after the lock was released")
+	}
+	if n := atomic.LoadInt32(&m.waiters); n != 0 {
+		t.Errorf("%d waiters remain after all goroutines unlocked", n)
+	}
+}
+
+// TestAdaptiveMutexTimeouts mixes waiters that give up with waiters that
+// do not, so that handovers race with waiters withdrawing.
+func TestAdaptiveMutexTimeouts(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const numIterations = 20000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	var m AdaptiveMutex
+	var wg sync.WaitGroup
+	var counter, expected int64
+
+	wg.Add(numConcurGoRoutines)
+	for g := 0; g < numConcurGoRoutines; g++ {
+		go func(g int) {
+			for i := 0; i < numIterations; i++ {
+				if g%2 == 0 {
+					m.Lock()
+				} else if !m.LockTimeout(time.Microsecond) {
+					continue
+				}
+				counter++
+				atomic.AddInt64(&expected, 1)
+				m.Unlock()
+			}
+			wg.Done()
+		}(g)
+	}
+	wg.Wait()
+
+	if counter != expected {
+		t.Fatalf("Counter is %d, but we expected %d", counter, expected)
+	}
+	if m.IsLocked() {
+		t.Error("IsLocked reported true after all goroutines unlocked")
+	}
+	if n := atomic.LoadInt32(&m.waiters); n != 0 {
+		t.Errorf("%d waiters remain after all goroutines unlocked", n)
+	}
+}
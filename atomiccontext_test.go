@@ -7,15 +7,13 @@ import (
 	"sync"
 	"testing"
 	"time"
-
-	"github.com/intel-go/cpuid"
 )
 
 func TestLockedContext(t *testing.T) {
 	run := func(t *testing.T, lock sync.Locker) {
 		const numConcurGoRoutines = 8
 		const arrayLength = 100
-		const numIterations = 5000000
+		const numIterations = 5000000 / raceScale
 
 		oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
 
@@ -79,12 +77,12 @@ func TestLockedContext(t *testing.T) {
 }
 
 func TestRTMContext(t *testing.T) {
-	run := func(t *testing.T, lock sync.Locker) {
+	run := func(t *testing.T, lock sync.Locker, opts ...RTMOption) {
 		const numConcurGoRoutines = 8
 		const arrayLength = 100
-		const numIterations = 5000000
+		const numIterations = 5000000 / raceScale
 
-		if !cpuid.HasExtendedFeature(cpuid.RTM) {
+		if !RTMAvailable() {
 			// Let's not fail for Travis-CI
 			fmt.Println("The CPU does not support Intel RTM - Skipping RTM Test!")
 			t.Log("The CPU does not support Intel RTM - Skipping RTM Test!")
@@ -98,9 +96,9 @@ func TestRTMContext(t *testing.T) {
 		var arr = make([]int, arrayLength)
 		var c *RTMContext
 		if lock == nil {
-			c = NewRTMContexDefault()
+			c = NewRTMContexDefault(opts...)
 		} else {
-			c = NewRTMContex(lock)
+			c = NewRTMContex(lock, opts...)
 		}
 
 		routine := func() {
@@ -130,10 +128,15 @@ func TestRTMContext(t *testing.T) {
 		expected := numIterations * numConcurGoRoutines
 		t.Logf("Array Length=%d | NumberGoRoutines=%d | NumIterations=%d", len(arr), numConcurGoRoutines, numIterations)
 		t.Logf("ArraySum=%d | Expected=%d", sum, expected)
-		t.Logf("CapacityAborts=%d", c.CapacityAborts())
+		stats := c.Stats()
+		t.Logf("Commits=%d | Fallbacks=%d | Aborts=%d | CapacityAborts=%d | ConflictAborts=%d",
+			stats.Commits, stats.Fallbacks, stats.Aborts, stats.Capacity, stats.Conflict)
 		if sum != expected {
 			t.Fatalf("Sum result is %d, but we expected %d", sum, expected)
 		}
+		if executions := stats.Commits + stats.Fallbacks; executions != uint64(expected) {
+			t.Fatalf("Commits+Fallbacks is %d, but we expected %d", executions, expected)
+		}
 
 		runtime.GOMAXPROCS(oldmaxprocs)
 	}
@@ -157,4 +160,232 @@ func TestRTMContext(t *testing.T) {
 	t.Run("SpinMutexBasic", func(t *testing.T) {
 		run(t, new(SpinMutexBasic))
 	})
+
+	t.Run("Policy", func(t *testing.T) {
+		run(t, new(SpinMutex),
+			WithMaxAttempts(8),
+			WithRetryOn(AbortRetry|AbortConflict),
+			WithRandomBackoff(1, 64),
+			WithWaitForFallback(),
+		)
+	})
+}
+
+func TestAutoContext(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const arrayLength = 100
+	const numIterations = 500000 / raceScale
+
+	c := NewAutoContext()
+	switch c.(type) {
+	case *RTMContext:
+		if !RTMAvailable() {
+			t.Fatal("NewAutoContext returned an RTMContext, but RTM is not available")
+		}
+	case *LockedContext:
+		if RTMAvailable() {
+			t.Fatal("NewAutoContext returned a LockedContext, but RTM is available")
+		}
+	default:
+		t.Fatalf("NewAutoContext returned an unexpected type %T", c)
+	}
+	t.Logf("RTMAvailable=%v | Context=%T", RTMAvailable(), c)
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	var wg sync.WaitGroup
+	var arr = make([]int, arrayLength)
+
+	routine := func() {
+		randsrc := rand.NewSource(int64(time.Now().Second()))
+		r := rand.New(randsrc)
+
+		for i := 0; i < numIterations; i++ {
+			index := r.Int() % len(arr)
+			c.Atomic(func() {
+				arr[index]++
+			})
+		}
+		wg.Done()
+	}
+
+	wg.Add(numConcurGoRoutines)
+	for i := 0; i < numConcurGoRoutines; i++ {
+		go routine()
+	}
+	wg.Wait()
+
+	var sum int
+	for _, v := range arr {
+		sum += v
+	}
+
+	expected := numIterations * numConcurGoRoutines
+	if sum != expected {
+		t.Fatalf("Sum result is %d, but we expected %d", sum, expected)
+	}
+}
+
+func TestRWAtomicContext(t *testing.T) {
+	run := func(t *testing.T, c RWAtomicContext) {
+		const numWriters = 4
+		const numReaders = 4
+		const numIterations = 200000 / raceScale
+
+		oldmaxprocs := runtime.GOMAXPROCS(numWriters + numReaders)
+		defer runtime.GOMAXPROCS(oldmaxprocs)
+
+		var wg sync.WaitGroup
+		var a, b int
+		var torn int32
+
+		wg.Add(numWriters + numReaders)
+		for i := 0; i < numWriters; i++ {
+			go func() {
+				for i := 0; i < numIterations; i++ {
+					c.Atomic(func() {
+						a++
+						b++
+					})
+				}
+				wg.Done()
+			}()
+		}
+		for i := 0; i < numReaders; i++ {
+			go func() {
+				for i := 0; i < numIterations; i++ {
+					c.AtomicRead(func() {
+						if a != b {
+							torn = 1
+						}
+					})
+				}
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+
+		if torn != 0 {
+			t.Fatal("A reader observed a partially applied commiter")
+		}
+		if expected := numWriters * numIterations; a != expected || b != expected {
+			t.Fatalf("Counters are %d and %d, but we expected %d", a, b, expected)
+		}
+	}
+
+	t.Run("LockedContext sync.RWMutex", func(t *testing.T) {
+		run(t, NewLockedContext(new(sync.RWMutex)))
+	})
+
+	t.Run("LockedContext SpinMutex", func(t *testing.T) {
+		run(t, NewLockedContext(new(SpinMutex)))
+	})
+
+	t.Run("LockedContext SpinRWMutex", func(t *testing.T) {
+		run(t, NewLockedContext(new(SpinRWMutex)))
+	})
+
+	t.Run("LockedContext ElidedRWMutex", func(t *testing.T) {
+		run(t, NewLockedContext(new(ElidedRWMutex)))
+	})
+
+	t.Run("RTMContext sync.RWMutex", func(t *testing.T) {
+		if !RTMAvailable() {
+			t.Skip("The CPU does not support Intel RTM - Skipping RTM Test!")
+		}
+		run(t, NewRTMContexRW())
+	})
+
+	t.Run("RTMContext SpinRWMutex", func(t *testing.T) {
+		if !RTMAvailable() {
+			t.Skip("The CPU does not support Intel RTM - Skipping RTM Test!")
+		}
+		run(t, NewRTMContex(new(SpinRWMutex)))
+	})
+
+	t.Run("RTMContext WaitForFallback", func(t *testing.T) {
+		if !RTMAvailable() {
+			t.Skip("The CPU does not support Intel RTM - Skipping RTM Test!")
+		}
+		run(t, NewRTMContexRW(WithWaitForFallback(), WithMaxAttempts(16)))
+	})
+}
+
+func TestLockedContextConcurrentReaders(t *testing.T) {
+	c := NewLockedContext(new(sync.RWMutex))
+
+	inside := make(chan struct{})
+	done := make(chan struct{})
+	go c.AtomicRead(func() {
+		close(inside)
+		<-done
+	})
+	<-inside
+
+	entered := make(chan struct{})
+	go c.AtomicRead(func() {
+		close(entered)
+	})
+
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A second reader was blocked by the first reader")
+	}
+	close(done)
+}
+
+func TestTryAtomic(t *testing.T) {
+	run := func(t *testing.T, c TryAtomicContext, lock sync.Locker) {
+		var x int
+		if !c.TryAtomic(func() { x++ }) {
+			t.Fatal("TryAtomic did not execute the commiter on a free context")
+		}
+
+		lock.Lock()
+		executed := c.TryAtomic(func() { x++ })
+		lock.Unlock()
+		if executed {
+			t.Fatal("TryAtomic executed the commiter while the lock was held")
+		}
+
+		if x != 1 {
+			t.Fatalf("x is %d instead of 1", x)
+		}
+	}
+
+	t.Run("LockedContext", func(t *testing.T) {
+		lock := new(sync.Mutex)
+		run(t, NewLockedContext(lock), lock)
+	})
+
+	t.Run("LockedContext SpinMutex", func(t *testing.T) {
+		lock := new(SpinMutex)
+		run(t, NewLockedContext(lock), lock)
+	})
+
+	t.Run("RTMContext", func(t *testing.T) {
+		if !RTMAvailable() {
+			t.Skip("The CPU does not support Intel RTM - Skipping RTM Test!")
+		}
+		c := NewRTMContexDefault()
+		var x int
+		if !c.TryAtomic(func() { x++ }) {
+			t.Fatal("TryAtomic did not execute the commiter on a free context")
+		}
+		inside := make(chan struct{})
+		done := make(chan struct{})
+		go c.AtomicTx(func(tx *Tx) {
+			// Force the fallback path, so the context is held
+			tx.Abort(1)
+			close(inside)
+			<-done
+		})
+		<-inside
+		if c.TryAtomic(func() { x++ }) {
+			t.Error("TryAtomic executed the commiter while the fallback lock was held")
+		}
+		close(done)
+	})
 }
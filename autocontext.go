@@ -0,0 +1,11 @@
+package safetyfast
+
+// NewAutoContext creates an AtomicContext that uses Intel RTM when the CPU
+// supports it. When RTM is not available, it returns a LockedContext that
+// uses a SpinMutex.
+func NewAutoContext() AtomicContext {
+	if RTMAvailable() {
+		return NewRTMContexDefault()
+	}
+	return NewLockedContext(new(SpinMutex))
+}
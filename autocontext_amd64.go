@@ -0,0 +1,45 @@
+//go:build !race
+// +build !race
+
+package safetyfast
+
+import (
+	"sync"
+
+	rtm "github.com/0xmjk/go-tsx-rtm"
+	"github.com/intel-go/cpuid"
+)
+
+// rtmProbeAttempts is the number of trivial transactions that are attempted
+// when deciding if RTM is usable on this CPU.
+const rtmProbeAttempts = 64
+
+var (
+	rtmProbeOnce sync.Once
+	rtmUsable    bool
+)
+
+// probeRTM reports if the CPU advertises Intel RTM and is actually able to
+// commit a transaction. Some microcode updates leave the RTM CPUID bit set,
+// but force every transaction to abort.
+func probeRTM() bool {
+	if !cpuid.HasExtendedFeature(cpuid.RTM) {
+		return false
+	}
+	for i := 0; i < rtmProbeAttempts; i++ {
+		if status := rtm.TxBegin(); status == rtm.TxBeginStarted {
+			rtm.TxEnd()
+			return true
+		}
+	}
+	return false
+}
+
+// RTMAvailable reports if Intel RTM is present and usable on this CPU.
+// The CPU is only probed once, the result is cached for subsequent calls.
+func RTMAvailable() bool {
+	rtmProbeOnce.Do(func() {
+		rtmUsable = probeRTM()
+	})
+	return rtmUsable
+}
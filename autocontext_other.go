@@ -0,0 +1,11 @@
+//go:build !amd64 || race
+// +build !amd64 race
+
+package safetyfast
+
+// RTMAvailable reports if Intel RTM is present and usable on this CPU.
+// RTM is only supported on amd64, and never when built with the race
+// detector, since it can not track memory accessed within a transaction.
+func RTMAvailable() bool {
+	return false
+}
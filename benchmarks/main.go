@@ -46,6 +46,18 @@ var syncprimitives = map[string]testlock{
 		name: "SpinRTMWithLibrary",
 		m:    new(sync.Mutex),
 	},
+	"mcsmutex": {
+		name: "MCSMutex",
+		m:    new(safetyfast.MCSMutex),
+	},
+	"adaptivemutex": {
+		name: "AdaptiveMutex",
+		m:    new(safetyfast.AdaptiveMutex),
+	},
+	"mcslock": {
+		name: "MCSLockWithNodes",
+		m:    new(sync.Mutex),
+	},
 }
 
 type BinTouchCounter struct {
@@ -170,6 +182,19 @@ func GoRoutineRTMWithLibrary(wg *sync.WaitGroup, values *RandValues, btc *BinTou
 	wg.Done()
 }
 
+// GoRoutineMCSLock exercises MCSLock with a queue node per goroutine
+func GoRoutineMCSLock(wg *sync.WaitGroup, values *RandValues, btc *BinTouchCounter, l *safetyfast.MCSLock) {
+	var node safetyfast.MCSNode
+	vals := values.GetAll()
+	for _, v := range vals {
+		index := int(v.(int32))
+		l.Lock(&node)
+		btc.Touch(index)
+		l.Unlock(&node)
+	}
+	wg.Done()
+}
+
 var FlagLockType string
 var FlagCSV bool
 var FlagNumBinStart int64
@@ -177,7 +202,7 @@ var FlagNumBinEnd int64
 var FlagPlotFileName string
 
 func init() {
-	flag.StringVar(&FlagLockType, "lock", "all", "SystemMutex | SpinMutex | SpinHLEMutex | SpinRTM | SpinRTMNoPause | SpinRTMWithLibrary | all")
+	flag.StringVar(&FlagLockType, "lock", "all", "SystemMutex | SpinMutex | SpinHLEMutex | SpinRTM | SpinRTMNoPause | SpinRTMWithLibrary | MCSMutex | MCSLock | AdaptiveMutex | all")
 	flag.BoolVar(&FlagCSV, "csv", false, "Indicates if the output should be CSV format")
 	flag.Int64Var(&FlagNumBinStart, "binsstart", 1, "")
 	flag.Int64Var(&FlagNumBinEnd, "binsend", 1000000000, "")
@@ -255,6 +280,11 @@ func main() {
 				for gid := 0; gid < numGoRoutines; gid++ {
 					go GoRoutineRTMWithLibrary(&wg, values[gid], btc, r)
 				}
+			} else if l.name == "MCSLockWithNodes" {
+				var l safetyfast.MCSLock
+				for gid := 0; gid < numGoRoutines; gid++ {
+					go GoRoutineMCSLock(&wg, values[gid], btc, &l)
+				}
 			} else {
 				for gid := 0; gid < numGoRoutines; gid++ {
 					go GoRoutine(&wg, values[gid], btc, m)
@@ -0,0 +1,110 @@
+package safetyfast
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// casnStripes is the number of spin locks that words are hashed to, when
+// CASN can not use RTM. It must be a power of 2.
+const casnStripes = 256
+
+// casnStripe is a spin lock, padded to its own cache lines.
+type casnStripe struct {
+	lock SpinMutex
+	_    [124]byte
+}
+
+// casnLocks holds the striped locks that protect words on the fallback path.
+// Transactions read the locks of their words, so they abort when a word is
+// being swapped on the fallback path.
+var casnLocks [casnStripes]casnStripe
+
+// CASEntry describes one word of a CASN operation.
+// Either Addr, Old and New describe a uint64 word, or, when Addr is nil,
+// Ptr, OldPtr and NewPtr describe an unsafe.Pointer word.
+type CASEntry struct {
+	Addr     *uint64
+	Old, New uint64
+
+	Ptr            *unsafe.Pointer
+	OldPtr, NewPtr unsafe.Pointer
+}
+
+// stripe returns the index of the lock that protects the entry's word.
+func (e *CASEntry) stripe() int {
+	p := uintptr(unsafe.Pointer(e.Addr))
+	if e.Addr == nil {
+		p = uintptr(unsafe.Pointer(e.Ptr))
+	}
+	return int((p>>3)^(p>>11)) & (casnStripes - 1)
+}
+
+// matches reports if the entry's word holds its old value.
+func (e *CASEntry) matches() bool {
+	if e.Addr != nil {
+		return atomic.LoadUint64(e.Addr) == e.Old
+	}
+	return atomic.LoadPointer(e.Ptr) == e.OldPtr
+}
+
+// swap writes the entry's new value to its word.
+func (e *CASEntry) swap() {
+	if e.Addr != nil {
+		atomic.StoreUint64(e.Addr, e.New)
+		return
+	}
+	atomic.StorePointer(e.Ptr, e.NewPtr)
+}
+
+// CASN atomically compares each word of entries with its old value and,
+// only if all of them match, sets each word to its new value.
+// It reports if the words were swapped.
+//
+// When RTM is available, CASN runs as a single transaction. Otherwise, or
+// if the transaction keeps aborting, the locks the words hash to are taken
+// in address order. Words must not be modified by anything but CASN, while
+// they may be used by CASN. They may be read at any time using sync/atomic,
+// but a consistent read of several words is a CASN with equal old and new
+// values. Each word may only appear once in entries.
+func CASN(entries []CASEntry) bool {
+	if RTMAvailable() {
+		if swapped, ok := casnTx(entries); ok {
+			return swapped
+		}
+	}
+	return casnLocked(entries)
+}
+
+// casnLocked runs CASN while holding the locks of all words.
+func casnLocked(entries []CASEntry) bool {
+	// Lock the stripes in ascending order, so that concurrent calls can not
+	// deadlock
+	var buf [8]int
+	stripes := buf[:0]
+	for i := range entries {
+		stripes = insertSorted(stripes, entries[i].stripe())
+	}
+	for _, s := range stripes {
+		casnLocks[s].lock.Lock()
+	}
+	swapped := casnApply(entries)
+	for _, s := range stripes {
+		casnLocks[s].lock.Unlock()
+	}
+	return swapped
+}
+
+// casnApply compares and swaps the words of entries, assuming no other CASN
+// can modify them.
+func casnApply(entries []CASEntry) bool {
+	for i := range entries {
+		if !entries[i].matches() {
+			return false
+		}
+	}
+	for i := range entries {
+		entries[i].swap()
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+//go:build !race
+// +build !race
+
+package safetyfast
+
+import rtm "github.com/0xmjk/go-tsx-rtm"
+
+// casnPolicy retries a CASN transaction a few times on transient aborts and
+// conflicts, before taking the locks.
+var casnPolicy = newRTMPolicy([]RTMOption{
+	WithMaxAttempts(4),
+	WithRetryOn(AbortRetry | AbortConflict),
+	WithRandomBackoff(1, 64),
+})
+
+// casnTx runs CASN as an RTM transaction. It reports if the swap was
+// decided, which is false if the transaction was given up on.
+//
+//go:nosplit
+func casnTx(entries []CASEntry) (swapped, ok bool) {
+	var attempt int
+retry:
+	attempt++
+	if status := rtm.TxBegin(); status == rtm.TxBeginStarted {
+		for i := range entries {
+			if casnLocks[entries[i].stripe()].lock.IsLocked() {
+				// Aborts with lockedAbortCode
+				rtm.TxAbort()
+			}
+		}
+		swapped = casnApply(entries)
+		rtm.TxEnd()
+		return swapped, true
+	} else if casnPolicy.shouldRetry(status, attempt) {
+		casnPolicy.backoff(attempt)
+		goto retry
+	}
+	return false, false
+}
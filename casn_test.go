@@ -0,0 +1,130 @@
+package safetyfast
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+func TestCASN(t *testing.T) {
+	var a, b uint64 = 10, 20
+	x, y := new(int), new(int)
+	p := unsafe.Pointer(x)
+
+	if CASN([]CASEntry{
+		{Addr: &a, Old: 10, New: 11},
+		{Addr: &b, Old: 21, New: 22},
+	}) {
+		t.Error("CASN swapped words that did not all match")
+	}
+	if a != 10 || b != 20 {
+		t.Errorf("A failed CASN modified the words to %d and %d", a, b)
+	}
+
+	if !CASN([]CASEntry{
+		{Addr: &a, Old: 10, New: 11},
+		{Addr: &b, Old: 20, New: 22},
+		{Ptr: &p, OldPtr: unsafe.Pointer(x), NewPtr: unsafe.Pointer(y)},
+	}) {
+		t.Error("CASN did not swap words that all matched")
+	}
+	if a != 11 || b != 22 || p != unsafe.Pointer(y) {
+		t.Errorf("CASN set the words to %d, %d and %p instead of 11, 22 and %p", a, b, p, y)
+	}
+
+	t.Run("Locked", func(t *testing.T) {
+		var c uint64
+		swapped := CASN([]CASEntry{{Addr: &c, Old: 0, New: 1}})
+		if !swapped || c != 1 {
+			t.Fatalf("CASN returned %v and set the word to %d", swapped, c)
+		}
+		if !casnLocked([]CASEntry{{Addr: &c, Old: 1, New: 2}}) || c != 2 {
+			t.Errorf("casnLocked did not swap the word, it is %d", c)
+		}
+		if casnLocked([]CASEntry{{Addr: &c, Old: 1, New: 3}}) || c != 2 {
+			t.Errorf("casnLocked swapped a word that did not match, it is %d", c)
+		}
+	})
+}
+
+// TestCASNTransfers moves amounts between accounts concurrently, and checks
+// that the total stays the same, as observed by consistent reads.
+func TestCASNTransfers(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const numAccounts = 16
+	const initial = 1000
+	const numIterations = 100000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	var accounts [numAccounts]uint64
+	for i := range accounts {
+		accounts[i] = initial
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(numConcurGoRoutines)
+	for g := 0; g < numConcurGoRoutines; g++ {
+		go func(g int) {
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < numIterations; i++ {
+				from, to := r.Intn(numAccounts), r.Intn(numAccounts)
+				if from == to {
+					continue
+				}
+				for {
+					fb := atomic.LoadUint64(&accounts[from])
+					tb := atomic.LoadUint64(&accounts[to])
+					amount := uint64(r.Intn(10))
+					if amount > fb {
+						amount = fb
+					}
+					if CASN([]CASEntry{
+						{Addr: &accounts[from], Old: fb, New: fb - amount},
+						{Addr: &accounts[to], Old: tb, New: tb + amount},
+					}) {
+						break
+					}
+				}
+			}
+			wg.Done()
+		}(g)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	entries := make([]CASEntry, numAccounts)
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		// Validate a snapshot of all accounts by swapping them with
+		// themselves
+		var total uint64
+		for i := range accounts {
+			v := atomic.LoadUint64(&accounts[i])
+			entries[i] = CASEntry{Addr: &accounts[i], Old: v, New: v}
+			total += v
+		}
+		if CASN(entries) && total != numAccounts*initial {
+			t.Fatalf("Consistent snapshot totals %d instead of %d", total, numAccounts*initial)
+		}
+	}
+
+	var total uint64
+	for _, v := range accounts {
+		total += v
+	}
+	if total != numAccounts*initial {
+		t.Fatalf("Accounts total %d instead of %d", total, numAccounts*initial)
+	}
+}
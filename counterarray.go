@@ -0,0 +1,314 @@
+package safetyfast
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// CounterMode selects how a CounterArray synchronizes its counters.
+type CounterMode int
+
+const (
+	// CounterAuto selects CounterRTM if RTM is available, and CounterAtomic
+	// otherwise, since its updates never wait for a preempted lock holder.
+	CounterAuto CounterMode = iota
+	// CounterRTM updates the counters within RTM transactions, which fall
+	// back to a single SpinMutex.
+	CounterRTM
+	// CounterStriped protects each cache line of counters with its own
+	// SpinMutex.
+	CounterStriped
+	// CounterAtomic updates the counters with atomic adds, which never wait
+	// for a preempted lock holder. Each cache line of counters has its own
+	// sequence lock, which snapshots use to retry until they copied the
+	// counters while no update was in progress.
+	CounterAtomic
+)
+
+// counterStripeSize is the number of counters in one 64 byte cache line,
+// which share a stripe lock in CounterStriped mode.
+const counterStripeSize = 8
+
+// counterSnapshotAttempts is the number of times a snapshot in
+// CounterAtomic mode copies the counters while updates keep running, before
+// updates are made to wait for the copy to complete.
+const counterSnapshotAttempts = 4
+
+// counterStripe is a stripe lock, padded to its own cache lines.
+type counterStripe struct {
+	lock SpinMutex
+	_    [124]byte
+}
+
+// counterSeq is the sequence lock of a stripe in CounterAtomic mode, padded
+// to its own cache lines. The low 32 bits count the updates in progress on
+// the stripe, and the high 32 bits count the updates that completed, so
+// that a snapshot can tell if any update ran while it copied the counters.
+type counterSeq struct {
+	seq uint64
+	_   [120]byte
+}
+
+// counterSeqEnd is added to a counterSeq to complete an update, which
+// increments the completed count and decrements the in progress count.
+const counterSeqEnd = 1<<32 - 1
+
+// CounterArray is an array of counters that is safe for concurrent use,
+// like the bins of a histogram.
+// Any number of counters can be updated atomically using AddMany, so that
+// Snapshot and Sum never observe part of an update.
+type CounterArray struct {
+	counts []int64
+	mode   CounterMode
+	// ctx is used in CounterRTM mode
+	ctx *RTMContext
+	// stripes is used in CounterStriped mode
+	stripes []counterStripe
+	// seqs and snapshots are used in CounterAtomic mode
+	seqs []counterSeq
+	// snapshots is the number of snapshots that updates must wait for
+	snapshots int32
+}
+
+// NewCounterArray creates a CounterArray with n counters, using the fastest
+// synchronization the CPU supports.
+func NewCounterArray(n int) *CounterArray {
+	return NewCounterArrayMode(n, CounterAuto)
+}
+
+// NewCounterArrayMode creates a CounterArray with n counters, using the
+// synchronization selected by mode.
+func NewCounterArrayMode(n int, mode CounterMode) *CounterArray {
+	if mode == CounterAuto {
+		if RTMAvailable() {
+			mode = CounterRTM
+		} else {
+			mode = CounterAtomic
+		}
+	}
+	c := &CounterArray{
+		counts: make([]int64, n),
+		mode:   mode,
+	}
+	switch mode {
+	case CounterRTM:
+		c.ctx = NewRTMContex(new(SpinMutex))
+	case CounterStriped:
+		c.stripes = make([]counterStripe, (n+counterStripeSize-1)/counterStripeSize)
+	case CounterAtomic:
+		c.seqs = make([]counterSeq, (n+counterStripeSize-1)/counterStripeSize)
+	}
+	return c
+}
+
+// Mode returns the synchronization used by the CounterArray.
+func (c *CounterArray) Mode() CounterMode {
+	return c.mode
+}
+
+// Len returns the number of counters.
+func (c *CounterArray) Len() int {
+	return len(c.counts)
+}
+
+// checkIndex panics if i is out of range. Indices are checked before
+// entering a transaction or taking a lock, so that a panic does not leave a
+// lock held.
+func (c *CounterArray) checkIndex(i int) {
+	if uint(i) >= uint(len(c.counts)) {
+		panic(fmt.Sprintf("safetyfast: counter index %d out of range [0:%d]", i, len(c.counts)))
+	}
+}
+
+// Add adds delta to counter i.
+func (c *CounterArray) Add(i int, delta int64) {
+	c.checkIndex(i)
+	switch c.mode {
+	case CounterRTM:
+		c.ctx.Atomic(func() {
+			c.counts[i] += delta
+		})
+	case CounterStriped:
+		l := &c.stripes[i/counterStripeSize].lock
+		l.Lock()
+		c.counts[i] += delta
+		l.Unlock()
+	default:
+		c.waitSnapshots()
+		seq := &c.seqs[i/counterStripeSize].seq
+		atomic.AddUint64(seq, 1)
+		atomic.AddInt64(&c.counts[i], delta)
+		atomic.AddUint64(seq, counterSeqEnd)
+	}
+}
+
+// AddMany adds 1 to the counter of each of the indices, as a single atomic
+// update. An index that is repeated is incremented once per occurrence.
+func (c *CounterArray) AddMany(indices ...int) {
+	for _, i := range indices {
+		c.checkIndex(i)
+	}
+	switch c.mode {
+	case CounterRTM:
+		c.ctx.Atomic(func() {
+			for _, i := range indices {
+				c.counts[i]++
+			}
+		})
+	case CounterStriped:
+		// Lock the stripes in ascending order, so that concurrent calls
+		// can not deadlock
+		var buf [counterStripeSize]int
+		stripes := buf[:0]
+		for _, i := range indices {
+			stripes = insertSorted(stripes, i/counterStripeSize)
+		}
+		for _, s := range stripes {
+			c.stripes[s].lock.Lock()
+		}
+		for _, i := range indices {
+			c.counts[i]++
+		}
+		for _, s := range stripes {
+			c.stripes[s].lock.Unlock()
+		}
+	default:
+		// Start the update on all stripes before changing any counter, so
+		// that a snapshot that sees part of it also sees it in progress
+		c.waitSnapshots()
+		for _, i := range indices {
+			atomic.AddUint64(&c.seqs[i/counterStripeSize].seq, 1)
+		}
+		for _, i := range indices {
+			atomic.AddInt64(&c.counts[i], 1)
+		}
+		for _, i := range indices {
+			atomic.AddUint64(&c.seqs[i/counterStripeSize].seq, counterSeqEnd)
+		}
+	}
+}
+
+// insertSorted inserts v into the ascending slice s, unless it is already
+// present.
+func insertSorted(s []int, v int) []int {
+	i := len(s)
+	for i > 0 && s[i-1] > v {
+		i--
+	}
+	if i > 0 && s[i-1] == v {
+		return s
+	}
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+// waitSnapshots waits for the snapshots that could not complete while
+// updates kept running, in CounterAtomic mode.
+func (c *CounterArray) waitSnapshots() {
+	for atomic.LoadInt32(&c.snapshots) != 0 {
+		runtime.Gosched()
+	}
+}
+
+// view executes fn while excluding all updates, so that fn observes a
+// consistent state of all counters. It is used in CounterRTM and
+// CounterStriped mode.
+func (c *CounterArray) view(fn func()) {
+	if c.mode == CounterRTM {
+		c.ctx.AtomicRead(fn)
+		return
+	}
+	for i := range c.stripes {
+		c.stripes[i].lock.Lock()
+	}
+	fn()
+	for i := range c.stripes {
+		c.stripes[i].lock.Unlock()
+	}
+}
+
+// load copies the counters to dst in CounterAtomic mode, without excluding
+// updates. The copy is retried until no update was in progress or completed
+// on any stripe while it was made, so that it is consistent.
+func (c *CounterArray) load(dst []int64) {
+	seqs := make([]uint64, len(c.seqs))
+	for attempt := 1; ; attempt++ {
+		if attempt == counterSnapshotAttempts {
+			atomic.AddInt32(&c.snapshots, 1)
+			defer atomic.AddInt32(&c.snapshots, -1)
+		}
+		for i := range c.seqs {
+			seqs[i] = c.waitSeq(i)
+		}
+		for i := range dst {
+			dst[i] = atomic.LoadInt64(&c.counts[i])
+		}
+		if c.unchanged(seqs) {
+			return
+		}
+	}
+}
+
+// waitSeq waits until no update is in progress on stripe i, and returns
+// its sequence lock.
+func (c *CounterArray) waitSeq(i int) uint64 {
+	attempts := LockAttempts
+	for {
+		seq := atomic.LoadUint64(&c.seqs[i].seq)
+		if uint32(seq) == 0 {
+			return seq
+		}
+		Pause()
+		if attempts--; attempts == 0 {
+			attempts = LockAttempts
+			// Invoke scheduler to allow the updates to complete
+			runtime.Gosched()
+		}
+	}
+}
+
+// unchanged reports if the sequence locks of all stripes still hold seqs.
+func (c *CounterArray) unchanged(seqs []uint64) bool {
+	for i := range c.seqs {
+		if atomic.LoadUint64(&c.seqs[i].seq) != seqs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Snapshot returns a consistent copy of all counters.
+func (c *CounterArray) Snapshot() []int64 {
+	// Allocate outside of the view, so that taking a snapshot does not
+	// allocate within a transaction
+	snap := make([]int64, len(c.counts))
+	if c.mode == CounterAtomic {
+		c.load(snap)
+		return snap
+	}
+	c.view(func() {
+		copy(snap, c.counts)
+	})
+	return snap
+}
+
+// Sum returns the sum of all counters, as of a single point in time.
+func (c *CounterArray) Sum() int64 {
+	var sum int64
+	if c.mode == CounterAtomic {
+		for _, v := range c.Snapshot() {
+			sum += v
+		}
+		return sum
+	}
+	c.view(func() {
+		sum = 0
+		for _, v := range c.counts {
+			sum += v
+		}
+	})
+	return sum
+}
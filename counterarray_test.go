@@ -0,0 +1,166 @@
+package safetyfast
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCounterArray(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const numCounters = 100
+	const numIterations = 100000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	run := func(t *testing.T, mode CounterMode) {
+		c := NewCounterArrayMode(numCounters, mode)
+		if c.Mode() != mode || c.Len() != numCounters {
+			t.Fatalf("Created a CounterArray with Mode=%d Len=%d instead of %d and %d",
+				c.Mode(), c.Len(), mode, numCounters)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(numConcurGoRoutines)
+		for g := 0; g < numConcurGoRoutines; g++ {
+			go func(g int) {
+				for i := 0; i < numIterations; i++ {
+					c.Add(1+(g+i)%(numCounters-2), 2)
+					// The first and last counters are on different stripes,
+					// and are only ever updated together
+					c.AddMany(0, numCounters-1, 1+(g*i)%(numCounters-2))
+				}
+				wg.Done()
+			}(g)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+			snap := c.Snapshot()
+			if snap[0] != snap[numCounters-1] {
+				t.Fatalf("Snapshot saw a partial AddMany: first=%d last=%d", snap[0], snap[numCounters-1])
+			}
+		}
+
+		expected := int64(numConcurGoRoutines * numIterations * (2 + 3))
+		if sum := c.Sum(); sum != expected {
+			t.Fatalf("Sum result is %d, but we expected %d", sum, expected)
+		}
+		var snapSum int64
+		for _, v := range c.Snapshot() {
+			snapSum += v
+		}
+		if snapSum != expected {
+			t.Fatalf("Snapshot sum is %d, but we expected %d", snapSum, expected)
+		}
+	}
+
+	t.Run("RTM", func(t *testing.T) {
+		run(t, CounterRTM)
+	})
+
+	t.Run("Striped", func(t *testing.T) {
+		run(t, CounterStriped)
+	})
+
+	t.Run("Atomic", func(t *testing.T) {
+		run(t, CounterAtomic)
+	})
+}
+
+func TestCounterArrayAuto(t *testing.T) {
+	c := NewCounterArray(10)
+	if c.Mode() == CounterAuto {
+		t.Error("NewCounterArray did not select a mode")
+	}
+	if RTMAvailable() && c.Mode() != CounterRTM {
+		t.Errorf("NewCounterArray selected mode %d instead of CounterRTM", c.Mode())
+	}
+	if !RTMAvailable() && c.Mode() != CounterAtomic {
+		t.Errorf("NewCounterArray selected mode %d instead of CounterAtomic", c.Mode())
+	}
+	c.AddMany(1, 1, 2)
+	if snap := c.Snapshot(); snap[1] != 2 || snap[2] != 1 {
+		t.Errorf("AddMany(1, 1, 2) produced %v", snap)
+	}
+}
+
+func TestCounterArrayOutOfRange(t *testing.T) {
+	for _, mode := range []CounterMode{CounterRTM, CounterStriped, CounterAtomic} {
+		c := NewCounterArrayMode(10, mode)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("AddMany with an out of range index did not panic in mode %d", mode)
+				}
+			}()
+			c.AddMany(1, 10)
+		}()
+		// No lock may be left held by the panic
+		c.Add(1, 1)
+		if sum := c.Sum(); sum != 1 {
+			t.Errorf("Sum is %d instead of 1 in mode %d", sum, mode)
+		}
+	}
+}
+
+// counterGate is the baseline for BenchmarkCounterArrayAdd: atomic adds
+// that share a sync.RWMutex read lock, which snapshots take exclusively.
+type counterGate struct {
+	counts []int64
+	gate   sync.RWMutex
+}
+
+func (c *counterGate) Add(i int, delta int64) {
+	c.gate.RLock()
+	atomic.AddInt64(&c.counts[i], delta)
+	c.gate.RUnlock()
+}
+
+func BenchmarkCounterArrayAdd(b *testing.B) {
+	const numCounters = 64
+
+	run := func(b *testing.B, add func(i int, delta int64)) {
+		var next uint32
+		b.RunParallel(func(pb *testing.PB) {
+			// Each goroutine updates its own cache line of counters, so that
+			// only the synchronization is shared
+			i := int(atomic.AddUint32(&next, 1)*counterStripeSize) % numCounters
+			for pb.Next() {
+				add(i, 1)
+			}
+		})
+	}
+
+	b.Run("RWMutexGate", func(b *testing.B) {
+		c := &counterGate{counts: make([]int64, numCounters)}
+		run(b, c.Add)
+	})
+
+	for _, mode := range []struct {
+		name string
+		mode CounterMode
+	}{
+		{"RTM", CounterRTM},
+		{"Striped", CounterStriped},
+		{"Atomic", CounterAtomic},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			if mode.mode == CounterRTM && !RTMAvailable() {
+				b.Skip("The CPU does not support Intel RTM - Skipping RTM Benchmark!")
+			}
+			run(b, NewCounterArrayMode(numCounters, mode.mode).Add)
+		})
+	}
+}
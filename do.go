@@ -0,0 +1,46 @@
+package safetyfast
+
+// Go methods can not have type parameters, so the value returning forms of
+// Atomic are provided as functions that accept any AtomicContext.
+
+// Do executes fn atomically using c and returns its result.
+func Do[T any](c AtomicContext, fn func() T) T {
+	var result T
+	c.Atomic(func() {
+		result = fn()
+	})
+	return result
+}
+
+// DoRead executes the read-only fn atomically using c and returns its result.
+func DoRead[T any](c RWAtomicContext, fn func() T) T {
+	var result T
+	c.AtomicRead(func() {
+		result = fn()
+	})
+	return result
+}
+
+// DoErr executes fn atomically using c and returns its error.
+// Note that returning an error does not undo any changes fn has made.
+func DoErr(c AtomicContext, fn func() error) error {
+	var err error
+	c.Atomic(func() {
+		err = fn()
+	})
+	return err
+}
+
+// AtomicErr executes commiter atomically with respect to other commiters
+// launched from this context, and returns the commiter's error.
+// Note that returning an error does not undo any changes commiter has made.
+func (c *LockedContext) AtomicErr(commiter func() error) error {
+	return DoErr(c, commiter)
+}
+
+// AtomicErr executes commiter in an atomic fasion, and returns the
+// commiter's error.
+// Note that returning an error does not undo any changes commiter has made.
+func (r *RTMContext) AtomicErr(commiter func() error) error {
+	return DoErr(r, commiter)
+}
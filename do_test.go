@@ -0,0 +1,30 @@
+package safetyfast
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestDo(t *testing.T) {
+	c := NewLockedContext(new(sync.RWMutex))
+	var x int
+
+	if v := Do(c, func() int { x++; return x }); v != 1 {
+		t.Errorf("Do returned %d instead of 1", v)
+	}
+	if v := DoRead(c, func() int { return x * 10 }); v != 10 {
+		t.Errorf("DoRead returned %d instead of 10", v)
+	}
+
+	errTest := errors.New("test")
+	if err := c.AtomicErr(func() error { x++; return errTest }); err != errTest {
+		t.Errorf("AtomicErr returned %v instead of %v", err, errTest)
+	}
+	if err := DoErr(c, func() error { x++; return nil }); err != nil {
+		t.Errorf("DoErr returned %v instead of nil", err)
+	}
+	if x != 3 {
+		t.Errorf("x is %d instead of 3", x)
+	}
+}
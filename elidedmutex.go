@@ -0,0 +1,49 @@
+package safetyfast
+
+import (
+	"context"
+	"time"
+)
+
+// ElidedMutex is a sync.Locker that elides the lock using Intel RTM.
+//
+// Lock starts a transaction that only reads the lock, and Unlock commits
+// it, so critical sections that do not touch the same data run
+// concurrently. The lock is only taken after the transaction aborts too
+// many times, like after a conflict that keeps recurring or a capacity
+// abort. Critical sections must not make system calls or otherwise cause
+// aborts that can never succeed, or they always take the lock.
+//
+// Unlike SpinHLEMutex, ElidedMutex does not depend on HLE, which is disabled
+// by the microcode of most recent CPUs. When RTM is not available, it
+// behaves like a SpinMutex.
+// The zero value is an unlocked mutex.
+type ElidedMutex struct {
+	lock SpinMutex
+}
+
+// IsLocked reports if the lock is held.
+// A critical section that is elided does not hold the lock, so it is not
+// reported.
+func (m *ElidedMutex) IsLocked() bool {
+	return m.lock.IsLocked()
+}
+
+// TryLock tries to acquire the lock once, without waiting, and reports if
+// it succeeded. The lock is acquired for real, rather than elided, since
+// an elided section can not be abandoned without rolling back the caller.
+func (m *ElidedMutex) TryLock() bool {
+	return m.lock.TryLock()
+}
+
+// LockTimeout acquires the lock for real, unless it could not be acquired
+// within d. It reports if the lock was acquired.
+func (m *ElidedMutex) LockTimeout(d time.Duration) bool {
+	return m.lock.LockTimeout(d)
+}
+
+// LockContext acquires the lock for real, unless ctx is done first, in
+// which case it returns the context's error.
+func (m *ElidedMutex) LockContext(ctx context.Context) error {
+	return m.lock.LockContext(ctx)
+}
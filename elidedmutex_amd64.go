@@ -0,0 +1,63 @@
+//go:build !race
+// +build !race
+
+package safetyfast
+
+import rtm "github.com/0xmjk/go-tsx-rtm"
+
+// elidedPolicy retries an elided critical section a few times on transient
+// aborts and conflicts, and waits for the lock to be released, before
+// taking the lock.
+var elidedPolicy = newRTMPolicy([]RTMOption{
+	WithMaxAttempts(5),
+	WithRetryOn(AbortRetry | AbortConflict),
+	WithWaitForFallback(),
+})
+
+// Lock starts an elided critical section, or acquires the lock if the
+// section can not be elided.
+// When elided, Lock returns within a transaction that is committed by
+// Unlock. If the transaction aborts, execution resumes within Lock, which
+// retries or acquires the lock.
+//
+//go:nosplit
+func (m *ElidedMutex) Lock() {
+	if !RTMAvailable() {
+		m.lock.Lock()
+		return
+	}
+	var attempt int
+retry:
+	attempt++
+	if status := rtm.TxBegin(); status == rtm.TxBeginStarted {
+		if m.lock.IsLocked() {
+			// Aborts with lockedAbortCode
+			rtm.TxAbort()
+		}
+		return
+	} else if elidedPolicy.shouldRetry(status, attempt) {
+		elidedPolicy.backoff(attempt)
+		for m.lock.IsLocked() {
+			Pause()
+		}
+		goto retry
+	}
+	m.lock.Lock()
+}
+
+// Unlock ends the critical section. An elided section is committed, and
+// a lock that was acquired is released.
+// A lock held for real is always released first, so that sections that
+// were elided within it, or that it was taken within, unlock correctly.
+//
+//go:nosplit
+func (m *ElidedMutex) Unlock() {
+	if m.lock.IsLocked() {
+		m.lock.Unlock()
+		return
+	}
+	if !xtest() {
+		panic("safetyfast: unlock of unlocked ElidedMutex")
+	}
+	rtm.TxEnd()
+}
@@ -0,0 +1,15 @@
+//go:build !amd64 || race
+// +build !amd64 race
+
+package safetyfast
+
+// Lock acquires the lock.
+// RTM is not available, so the lock is never elided.
+func (m *ElidedMutex) Lock() {
+	m.lock.Lock()
+}
+
+// Unlock releases the lock.
+func (m *ElidedMutex) Unlock() {
+	m.lock.Unlock()
+}
@@ -0,0 +1,115 @@
+package safetyfast
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestElidedMutex(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const arrayLength = 100
+	const numIterations = 500000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	var m ElidedMutex
+	var wg sync.WaitGroup
+	arr := make([]int, arrayLength)
+
+	wg.Add(numConcurGoRoutines)
+	for g := 0; g < numConcurGoRoutines; g++ {
+		go func(seed int64) {
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < numIterations; i++ {
+				index := r.Intn(arrayLength)
+				m.Lock()
+				arr[index]++
+				m.Unlock()
+			}
+			wg.Done()
+		}(int64(g))
+	}
+	wg.Wait()
+
+	var sum int
+	for _, v := range arr {
+		sum += v
+	}
+	if expected := numIterations * numConcurGoRoutines; sum != expected {
+		t.Fatalf("Sum result is %d, but we expected %d", sum, expected)
+	}
+	if m.IsLocked() {
+		t.Error("IsLocked reported true after all sections ended")
+	}
+}
+
+// TestElidedMutexNested nests two mutexes, always in the same order, and
+// also locks them alone, so that elided and acquired sections mix.
+func TestElidedMutexNested(t *testing.T) {
+	const numConcurGoRoutines = 4
+	const numIterations = 100000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	var outer, inner ElidedMutex
+	var a, b int
+	var wg sync.WaitGroup
+
+	wg.Add(numConcurGoRoutines)
+	for g := 0; g < numConcurGoRoutines; g++ {
+		go func(g int) {
+			for i := 0; i < numIterations; i++ {
+				switch (g + i) % 3 {
+				case 0:
+					outer.Lock()
+					inner.Lock()
+					a++
+					b++
+					inner.Unlock()
+					outer.Unlock()
+				case 1:
+					outer.Lock()
+					a++
+					outer.Unlock()
+					inner.Lock()
+					b++
+					inner.Unlock()
+				case 2:
+					// Unlock in the same order as the locks were taken
+					outer.Lock()
+					inner.Lock()
+					a++
+					b++
+					outer.Unlock()
+					inner.Unlock()
+				}
+			}
+			wg.Done()
+		}(g)
+	}
+	wg.Wait()
+
+	if expected := numConcurGoRoutines * numIterations; a != expected || b != expected {
+		t.Fatalf("Counters are %d and %d, but we expected %d", a, b, expected)
+	}
+}
+
+func TestElidedMutexIsLocked(t *testing.T) {
+	var m ElidedMutex
+	if m.IsLocked() {
+		t.Error("IsLocked reported true for a new lock")
+	}
+	// An elided section does not hold the lock, so only check that the
+	// section can be entered and left repeatedly
+	for i := 0; i < 10; i++ {
+		m.Lock()
+		m.Unlock()
+	}
+	if m.IsLocked() {
+		t.Error("IsLocked reported true for a released lock")
+	}
+}
@@ -1,6 +1,12 @@
 package safetyfast
 
-func ExampleHLE() {
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+func ExampleSpinHLEMutex() {
 
 	m := map[string]int{
 		"word1": 0,
@@ -18,7 +24,7 @@ func ExampleHLE() {
 
 }
 
-func ExampleHLE2() {
+func ExampleLockedContext() {
 
 	m := map[string]int{
 		"word1": 0,
@@ -36,7 +42,7 @@ func ExampleHLE2() {
 
 }
 
-func ExampleRTM() {
+func ExampleRTMContext() {
 
 	m := map[string]int{
 		"word1": 0,
@@ -52,3 +58,32 @@ func ExampleRTM() {
 		m["word1"] = count + 1
 	})
 }
+
+func ExampleDo() {
+
+	m := map[string]int{
+		"word1": 0,
+		"word2": 0,
+	}
+
+	c := NewLockedContext(new(sync.Mutex))
+	count := Do(c, func() int {
+		// Action to be done transactionally
+		m["word1"]++
+		return m["word1"]
+	})
+	fmt.Println("word1 =", count)
+
+	err := DoErr(c, func() error {
+		if _, ok := m["word3"]; !ok {
+			return errors.New("word3 not found")
+		}
+		m["word3"]++
+		return nil
+	})
+	fmt.Println(err)
+
+	// Output:
+	// word1 = 1
+	// word3 not found
+}
@@ -0,0 +1,61 @@
+//go:build (!386 && !amd64) || race
+// +build !386,!amd64 race
+
+// HLE is only available on x86, so the HLE functions behave like their
+// plain spin lock counterparts on all other architectures, and when building
+// with the race detector.
+
+package safetyfast
+
+import "sync/atomic"
+
+// HLETryLock attempts only once to acquire the lock by writing a 1 to val.
+// This function returns a 0 if the lock was acquired.
+// HLE is not available on this architecture, so no elision takes place.
+func HLETryLock(val *int32) int32 {
+	return atomic.SwapInt32(val, 1)
+}
+
+// HLESpinLock repeatedly tries to set val to 1.
+// HLE is not available on this architecture, so this is equivalent to
+// SpinLock.
+// Please note that this function will never return unless the lock is acquired.
+func HLESpinLock(val *int32) {
+	SpinLock(val)
+}
+
+// HLESpinCountLock tries to set val to 1 at most attempts times.
+// HLE is not available on this architecture, so this is equivalent to
+// SpinCountLock.
+// If attempts is 0 when the function returns, the lock was not acquired and
+// the spin lock gave up.
+// Please note that attempts must be greater 0 when called.
+func HLESpinCountLock(val, attempts *int32) {
+	SpinCountLock(val, attempts)
+}
+
+// HLEUnlock writes a 0 to val to indicate the lock has been released.
+func HLEUnlock(val *int32) {
+	atomic.StoreInt32(val, 0)
+}
+
+// HLETicketAcquire takes the next ticket of the ticket lock val, and returns
+// the old value of val.
+// HLE is not available on this architecture, so no elision takes place.
+func HLETicketAcquire(val *uint32) (old uint32) {
+	return atomic.AddUint32(val, 1<<16) - 1<<16
+}
+
+// HLETicketRelease hands the ticket lock val on from ticket, which must own
+// the lock, to the next ticket.
+// HLE is not available on this architecture, so no elision takes place.
+func HLETicketRelease(val *uint32, ticket uint32) {
+	for {
+		old := atomic.LoadUint32(val)
+		// Only the owner modifies the lower 16 bits, so the increment must
+		// not carry into the next ticket
+		if atomic.CompareAndSwapUint32(val, old, old&^0xffff|(old+1)&0xffff) {
+			return
+		}
+	}
+}
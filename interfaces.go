@@ -1,5 +1,7 @@
 package safetyfast
 
+import "sync"
+
 // AtomicContext is the interface provided by a synchronization primitive
 // that is capable of running a functions in an atomic context.
 type AtomicContext interface {
@@ -8,3 +10,50 @@ type AtomicContext interface {
 	// AtomicContext.
 	Atomic(commiter func())
 }
+
+// RWAtomicContext is an AtomicContext that can also run read-only functions.
+// Readers launched from the context may run concurrently with each other,
+// but never with a commiter.
+type RWAtomicContext interface {
+	AtomicContext
+	// AtomicRead will execute reader exactly once per call in a manor that
+	// appears to be atomic with respect to commiters launched from this
+	// RWAtomicContext.
+	// The reader must not modify any state shared with other readers or
+	// commiters.
+	AtomicRead(reader func())
+}
+
+// RWLocker is a sync.Locker that can also be locked for shared reading,
+// like sync.RWMutex.
+type RWLocker interface {
+	sync.Locker
+	RLock()
+	RUnlock()
+}
+
+// TryAtomicContext is an AtomicContext that can also attempt to run a
+// commiter without waiting.
+type TryAtomicContext interface {
+	AtomicContext
+	// TryAtomic will execute commiter at most once, in a manor that appears
+	// to be atomic with respect to other commiters launched from this
+	// TryAtomicContext, but only if it can do so without waiting for
+	// another commiter. It reports if commiter was executed.
+	TryAtomic(commiter func()) bool
+}
+
+// TryLocker is a sync.Locker that can also attempt to acquire the lock
+// without waiting, like sync.Mutex.
+type TryLocker interface {
+	sync.Locker
+	TryLock() bool
+}
+
+// LockStateReader is implemented by locks whose state can be read directly.
+// An RTMContext uses it to read the lock's state within a transaction,
+// instead of maintaining a separate fallback flag.
+type LockStateReader interface {
+	// IsLocked reports if the lock is currently held.
+	IsLocked() bool
+}
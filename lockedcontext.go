@@ -3,14 +3,20 @@ package safetyfast
 import "sync"
 
 // LockedContext provides an AtomicContext that utilizes any sync.Locker.
+// If the sync.Locker is also an RWLocker, like sync.RWMutex, readers
+// launched using AtomicRead may run concurrently.
 type LockedContext struct {
-	lock sync.Locker
+	lock    sync.Locker
+	rlock   RWLocker
+	trylock TryLocker
 }
 
 // NewLockedContext creates a LockedContext that uses lock as the sync method.
 func NewLockedContext(lock sync.Locker) *LockedContext {
 	c := new(LockedContext)
 	c.lock = lock
+	c.rlock, _ = lock.(RWLocker)
+	c.trylock, _ = lock.(TryLocker)
 	return c
 }
 
@@ -22,3 +28,30 @@ func (c *LockedContext) Atomic(commiter func()) {
 	commiter()
 	c.lock.Unlock()
 }
+
+// AtomicRead executes reader atomically with respect to commiters launched
+// from this context.
+// If the context's lock is an RWLocker, the read lock is used, so that
+// concurrent readers do not block each other.
+func (c *LockedContext) AtomicRead(reader func()) {
+	if c.rlock == nil {
+		c.Atomic(reader)
+		return
+	}
+	c.rlock.RLock()
+	reader()
+	c.rlock.RUnlock()
+}
+
+// TryAtomic executes commiter atomically with respect to other commiters
+// launched from this context, but only if the lock can be acquired without
+// waiting. It reports if commiter was executed.
+// If the context's lock is not a TryLocker, commiter is never executed.
+func (c *LockedContext) TryAtomic(commiter func()) bool {
+	if c.trylock == nil || !c.trylock.TryLock() {
+		return false
+	}
+	commiter()
+	c.trylock.Unlock()
+	return true
+}
@@ -0,0 +1,288 @@
+package safetyfast
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// LockAttempts sets how many times the spin loop is willing to try to
+// fetching the lock.
+const LockAttempts = int32(200)
+
+// SpinLockAtomics implements a very basic spin forever style lock that
+// uses the built in atomics.SwapInt32 function in order to claim the lock.
+func SpinLockAtomics(val *int32) {
+	for {
+		// Spin on simple read
+		for atomic.LoadInt32(val) != 0 {
+			// ASM hint for spin loop
+			Pause()
+		}
+		if atomic.SwapInt32(val, 1) == 0 {
+			break
+		}
+	}
+}
+
+// lockWithin acquires a lock by calling spinRound, which spins for at most
+// one round of LockAttempts, until expired reports true between rounds.
+// It reports if the lock was acquired.
+func lockWithin(spinRound func() bool, expired func() bool) bool {
+	for {
+		if spinRound() {
+			return true
+		}
+		if expired() {
+			return false
+		}
+		// Invoke scheduler to allow other to run
+		runtime.Gosched()
+	}
+}
+
+// lockTimeout acquires a lock using spinRound, giving up once d has
+// elapsed. At least one round is always attempted.
+func lockTimeout(spinRound func() bool, d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	return lockWithin(spinRound, func() bool {
+		return !time.Now().Before(deadline)
+	})
+}
+
+// lockContext acquires a lock using spinRound, giving up once ctx is done.
+// If ctx is already done, the lock is not attempted.
+func lockContext(spinRound func() bool, ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !lockWithin(spinRound, func() bool {
+		return ctx.Err() != nil
+	}) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// tryLockRound tries to acquire a lock using tryLock for at most
+// LockAttempts times. It is the spin round of queued locks, whose place in
+// the queue can not be given up once it is taken.
+func tryLockRound(tryLock func() bool) bool {
+	for attempts := LockAttempts; attempts > 0; attempts-- {
+		if tryLock() {
+			return true
+		}
+		Pause()
+	}
+	return false
+}
+
+type SpinMutexBasic struct {
+	val int32
+}
+
+func (m *SpinMutexBasic) Lock() {
+	for !atomic.CompareAndSwapInt32(&m.val, 0, 1) {
+		Pause()
+	}
+}
+
+// TryLock tries to acquire the lock once, without waiting, and reports if
+// it succeeded.
+func (m *SpinMutexBasic) TryLock() bool {
+	return atomic.CompareAndSwapInt32(&m.val, 0, 1)
+}
+
+func (m *SpinMutexBasic) spinRound() bool {
+	for attempts := LockAttempts; attempts > 0; attempts-- {
+		if m.TryLock() {
+			return true
+		}
+		Pause()
+	}
+	return false
+}
+
+// LockTimeout acquires the lock, unless it could not be acquired within d.
+// It reports if the lock was acquired.
+func (m *SpinMutexBasic) LockTimeout(d time.Duration) bool {
+	return lockTimeout(m.spinRound, d)
+}
+
+// LockContext acquires the lock, unless ctx is done first, in which case
+// it returns the context's error.
+func (m *SpinMutexBasic) LockContext(ctx context.Context) error {
+	return lockContext(m.spinRound, ctx)
+}
+
+func (m *SpinMutexBasic) Unlock() {
+	unlock32(&m.val)
+}
+
+func (m *SpinMutexBasic) IsLocked() bool {
+	return atomic.LoadInt32(&m.val) != 0
+}
+
+type SpinMutex int32
+
+// Fastest
+func (m *SpinMutex) Lock() {
+	for {
+		var attempts int32 = LockAttempts
+		SpinCountLock((*int32)(m), &attempts)
+		if attempts > 0 {
+			// We acquired the lock before attempts was exceeded
+			return
+		}
+		// Invoke scheduler to allow other to run
+		runtime.Gosched()
+	}
+}
+
+// TryLock tries to acquire the lock once, without waiting, and reports if
+// it succeeded.
+func (m *SpinMutex) TryLock() bool {
+	var attempts int32 = 1
+	SpinCountLock((*int32)(m), &attempts)
+	return attempts > 0
+}
+
+func (m *SpinMutex) spinRound() bool {
+	var attempts int32 = LockAttempts
+	SpinCountLock((*int32)(m), &attempts)
+	return attempts > 0
+}
+
+// LockTimeout acquires the lock, unless it could not be acquired within d.
+// It reports if the lock was acquired.
+func (m *SpinMutex) LockTimeout(d time.Duration) bool {
+	return lockTimeout(m.spinRound, d)
+}
+
+// LockContext acquires the lock, unless ctx is done first, in which case
+// it returns the context's error.
+func (m *SpinMutex) LockContext(ctx context.Context) error {
+	return lockContext(m.spinRound, ctx)
+}
+
+func (m *SpinMutex) Unlock() {
+	unlock32((*int32)(m))
+}
+
+func (m *SpinMutex) IsLocked() bool {
+	return atomic.LoadInt32((*int32)(m)) == 1
+}
+
+type SpinMutexASM int32
+
+func (m *SpinMutexASM) Lock() {
+	for {
+		// Spin on simple read
+		for atomic.LoadInt32((*int32)(m)) != 0 {
+			// ASM hint for spin loop
+			Pause()
+		}
+		if Lock1XCHG32((*int32)(m)) == 0 {
+			break
+		}
+	}
+	// for atomic.SwapInt32(&m.val, 1) != 0 {
+	// 	// Spin on simple read
+	// 	for m.val != 0 {
+	// 		// ASM hint for spin loop
+	// 		Pause()
+	// 	}
+	// }
+}
+
+// TryLock tries to acquire the lock once, without waiting, and reports if
+// it succeeded.
+func (m *SpinMutexASM) TryLock() bool {
+	return atomic.LoadInt32((*int32)(m)) == 0 && Lock1XCHG32((*int32)(m)) == 0
+}
+
+func (m *SpinMutexASM) spinRound() bool {
+	for attempts := LockAttempts; attempts > 0; attempts-- {
+		if m.TryLock() {
+			return true
+		}
+		Pause()
+	}
+	return false
+}
+
+// LockTimeout acquires the lock, unless it could not be acquired within d.
+// It reports if the lock was acquired.
+func (m *SpinMutexASM) LockTimeout(d time.Duration) bool {
+	return lockTimeout(m.spinRound, d)
+}
+
+// LockContext acquires the lock, unless ctx is done first, in which case
+// it returns the context's error.
+func (m *SpinMutexASM) LockContext(ctx context.Context) error {
+	return lockContext(m.spinRound, ctx)
+}
+
+func (m *SpinMutexASM) Unlock() {
+	unlock32((*int32)(m))
+}
+
+func (m *SpinMutexASM) IsLocked() bool {
+	return atomic.LoadInt32((*int32)(m)) != 0
+}
+
+// SpinHLEMutex is sync.Mutex replacement that uses HLE
+type SpinHLEMutex int32
+
+func (m *SpinHLEMutex) Lock() {
+	// HLESpinLock((*int32)(m))
+	for {
+		var attempts int32 = LockAttempts
+		HLESpinCountLock((*int32)(m), &attempts)
+
+		if attempts > 0 {
+			// We acquired the lock before attempts was exceeded
+			return
+		}
+		// Invoke scheduler to allow other to run
+		runtime.Gosched()
+	}
+}
+
+// TryLock tries to acquire the lock once using HLE, without waiting, and
+// reports if it succeeded.
+func (m *SpinHLEMutex) TryLock() bool {
+	// Only start eliding when the lock appears free, like HLESpinCountLock
+	return atomic.LoadInt32((*int32)(m)) == 0 && HLETryLock((*int32)(m)) == 0
+}
+
+func (m *SpinHLEMutex) spinRound() bool {
+	var attempts int32 = LockAttempts
+	HLESpinCountLock((*int32)(m), &attempts)
+	return attempts > 0
+}
+
+// LockTimeout acquires the lock, unless it could not be acquired within d.
+// It reports if the lock was acquired.
+func (m *SpinHLEMutex) LockTimeout(d time.Duration) bool {
+	return lockTimeout(m.spinRound, d)
+}
+
+// LockContext acquires the lock, unless ctx is done first, in which case
+// it returns the context's error.
+func (m *SpinHLEMutex) LockContext(ctx context.Context) error {
+	return lockContext(m.spinRound, ctx)
+}
+
+func (m *SpinHLEMutex) Unlock() {
+	HLEUnlock((*int32)(m))
+}
+
+// IsLocked reports if the lock is held.
+// When the lock has been elided by HLE, it appears free to other threads,
+// but the elided section still conflicts with any transaction touching the
+// same data.
+func (m *SpinHLEMutex) IsLocked() bool {
+	return atomic.LoadInt32((*int32)(m)) != 0
+}
@@ -0,0 +1,229 @@
+//go:build !race
+// +build !race
+
+// HLE instructions can work on 386 or amd64.
+// This is the 386 variant of locks_amd64.s, using 32 bit pointers and
+// argument offsets.
+
+#include "textflag.h"
+
+// func Pause()
+TEXT ·Pause(SB),NOPTR|NOSPLIT,$0-0
+    PAUSE
+    RET
+
+// func Mfence()
+TEXT ·Mfence(SB),NOPTR|NOSPLIT,$0-0
+    MFENCE
+    RET
+
+// SetAndFence32 writes a 1 to val and asserts an MFENCE.
+// func SetAndFence32(val *int32)
+TEXT ·SetAndFence32(SB),NOPTR|NOSPLIT,$0-4
+    MOVL val+0(FP), CX
+    MOVL $1, AX
+    MOVL AX, (CX)
+    MFENCE
+    RET
+
+// Atomically write 1 to val while returning the old value.
+// func Lock1XCHG8(val *int8) (old int8)
+TEXT ·Lock1XCHG8(SB),NOPTR|NOSPLIT,$0-5
+    MOVL val+0(FP), CX
+    MOVB $1, AX
+    LOCK
+    XCHGB AX, (CX)
+    MOVB AX, old+4(FP)
+    RET
+
+// Atomically write 1 to val while returning the old value.
+// func Lock1XCHG32(val *int32) (old int32)
+TEXT ·Lock1XCHG32(SB),NOPTR|NOSPLIT,$0-8
+    MOVL val+0(FP), CX
+    MOVL $1, AX
+    LOCK
+    XCHGL AX, (CX)
+    MOVL AX, old+4(FP)
+    RET
+
+// Atomically write 1 to val while returning the old value.
+// There is no 64 bit XCHG on 386, so this loops on CMPXCHG8B until
+// the swap succeeds.
+// func Lock1XCHG64(val *int64) (old int64)
+TEXT ·Lock1XCHG64(SB),NOPTR|NOSPLIT,$0-12
+    MOVL val+0(FP), DI
+    // New value in CX:BX
+    MOVL $1, BX
+    XORL CX, CX
+    // Expected old value in DX:AX
+    MOVL 0(DI), AX
+    MOVL 4(DI), DX
+retry:
+    LOCK
+    CMPXCHG8B (DI)
+    // On failure, DX:AX was loaded with the current value
+    JNE retry
+    MOVL AX, old_lo+4(FP)
+    MOVL DX, old_hi+8(FP)
+    RET
+
+// SpinLock implements a basic spin lock that waits forever until the lock
+// can be acquired.
+// It assumes the lock has been acquired when it successfully writes a 1 to val,
+// while the original value was 0.
+// This implementation spins on a read only and then uses the XCHG instruction
+// in order to claim the lock. The loop makes use of the PAUSE hint instruction.
+// func SpinLock(val *int32)
+TEXT ·SpinLock(SB),NOPTR|NOSPLIT,$0-4
+    MOVL val+0(FP), CX
+tryread:
+    MOVL (CX), BX
+    TESTL BX, BX
+    JE tryacquire
+    PAUSE
+    JMP tryread
+tryacquire:
+    MOVL $1, AX
+    LOCK
+    XCHGL AX, (CX)
+    TESTL AX, AX
+    JNE tryread
+    RET
+
+// SpinCountLock implements a basic spin lock that tries to acquire the lock
+// only attempts times.
+// It assumes the lock has been acquired when it successfully writes a 1 to val,
+// while the original value was 0.
+// This implementation spins on a read only and then uses the XCHG instruction
+// in order to claim the lock. The loop makes use of the PAUSE hint instruction.
+// func SpinCountLock(val, attempts *int32)
+TEXT ·SpinCountLock(SB),NOPTR|NOSPLIT,$0-8
+    MOVL val+0(FP), CX
+    // Load attempt counter in DX
+    MOVL attempts+4(FP), DI
+    MOVL (DI), DX
+tryread:
+    MOVL (CX), BX
+    TESTL BX, BX
+    JE tryacquire
+    PAUSE
+    DECL DX
+    // If DX != 0, abort
+    JNE tryread
+    JMP abort
+tryacquire:
+    MOVL $1, AX
+    LOCK
+    XCHGL AX, (CX)
+    TESTL AX, AX
+    JNE tryread
+abort:
+    // Write back attempt counter
+    MOVL DX, (DI)
+    RET
+
+// HLETryLock attempts only once to acquire the lock by writing a 1 to val
+// using HLE primitives. This function returns a 0 if the lock was acquired.
+// func HLETryLock(val *int32) int32
+TEXT ·HLETryLock(SB),NOPTR|NOSPLIT,$0-8
+    MOVL val+0(FP), CX
+    MOVL $1, AX
+    XACQUIRE
+    XCHGL AX, (CX)
+    MOVL AX, ret+4(FP)
+    RET
+
+// HLEUnlock writes a 0 to val to indicate the lock has been released
+// using HLE primitives
+// func HLEUnlock(val *int32)
+TEXT ·HLEUnlock(SB),NOPTR|NOSPLIT,$0-4
+    MOVL val+0(FP), CX
+    MOVL $0, AX
+    XRELEASE
+    MOVL AX, (CX)
+    RET
+
+// func HLESpinLock(val *int32)
+TEXT ·HLESpinLock(SB),NOPTR|NOSPLIT,$0-4
+    MOVL val+0(FP), CX
+tryread:
+    MOVL (CX), BX
+    TESTL BX, BX
+    JE tryacquire
+    PAUSE
+    JMP tryread
+tryacquire:
+    MOVL $1, AX
+    XACQUIRE
+    XCHGL AX, (CX)
+    TESTL AX, AX
+    JNE tryread
+    RET
+
+// Note: Argument attempts must be greater than 0
+// func HLESpinCountLock(val, attempts *int32)
+TEXT ·HLESpinCountLock(SB),NOPTR|NOSPLIT,$0-8
+    MOVL val+0(FP), CX
+    // Load attempt counter in DX
+    MOVL attempts+4(FP), DI
+    MOVL (DI), DX
+tryread:
+    MOVL (CX), BX
+    TESTL BX, BX
+    JE tryacquire
+    PAUSE
+    DECL DX
+    // If DX != 0, abort
+    JNE tryread
+    JMP abort
+tryacquire:
+    MOVL $1, AX
+    XACQUIRE
+    XCHGL AX, (CX)
+    TESTL AX, AX
+    JNE tryread
+abort:
+    // Write back attempt counter
+    MOVL DX, (DI)
+    RET
+
+// HLETicketAcquire takes the next ticket of the ticket lock val using
+// XACQUIRE LOCK XADD, and returns the old value of val.
+// func HLETicketAcquire(val *uint32) (old uint32)
+TEXT ·HLETicketAcquire(SB),NOPTR|NOSPLIT,$0-8
+    MOVL val+0(FP), CX
+    MOVL $0x10000, AX
+    XACQUIRE
+    LOCK
+    XADDL AX, (CX)
+    MOVL AX, old+4(FP)
+    RET
+
+// HLETicketRelease hands the ticket lock val on from ticket to the next
+// ticket. If no other ticket was taken, the ticket is returned instead using
+// XRELEASE LOCK CMPXCHG, which restores the value val had before
+// HLETicketAcquire, so that the lock can be elided.
+// func HLETicketRelease(val *uint32, ticket uint32)
+TEXT ·HLETicketRelease(SB),NOPTR|NOSPLIT,$0-8
+    MOVL val+0(FP), CX
+    MOVL ticket+4(FP), DX
+    ANDL $0xffff, DX
+    // Expect next == ticket+1 and owner == ticket in BX
+    MOVL DX, BX
+    INCL BX
+    SHLL $16, BX
+    ORL DX, BX
+    // Return to next == owner == ticket in DX
+    MOVL DX, AX
+    SHLL $16, AX
+    ORL AX, DX
+    MOVL BX, AX
+    XRELEASE
+    LOCK
+    CMPXCHGL DX, (CX)
+    JEQ done
+    // Other tickets were taken, so serve the next one
+    LOCK
+    INCW (CX)
+done:
+    RET
@@ -1,5 +1,8 @@
-// +build 386 amd64
-// HLE instructions can work on 386 or amd64
+//go:build !race
+// +build !race
+
+// HLE instructions can work on 386 or amd64.
+// See locks_386.s for the 386 implementation.
 
 #include "textflag.h"
 
@@ -109,13 +112,13 @@ abort:
 
 // HLETryLock attempts only once to acquire the lock by writing a 1 to val
 // using HLE primitives. This function returns a 0 if the lock was acquired.
-// func HLETryLock(val *int32) (old int32)
+// func HLETryLock(val *int32) int32
 TEXT ·HLETryLock(SB),NOPTR|NOSPLIT,$0
     MOVQ val+0(FP), CX
     MOVL $1, AX
     XACQUIRE
     XCHGL AX, (CX)
-    MOVL AX, old+8(FP)
+    MOVL AX, ret+8(FP)
     RET
 
 // HLEUnlock writes a 0 to val to indicate the lock has been released
@@ -171,3 +174,44 @@ abort:
     // Write back attempt counter
     MOVL DX, (R8)
     RET
+
+// HLETicketAcquire takes the next ticket of the ticket lock val using
+// XACQUIRE LOCK XADD, and returns the old value of val.
+// func HLETicketAcquire(val *uint32) (old uint32)
+TEXT ·HLETicketAcquire(SB),NOPTR|NOSPLIT,$0-12
+    MOVQ val+0(FP), CX
+    MOVL $0x10000, AX
+    XACQUIRE
+    LOCK
+    XADDL AX, (CX)
+    MOVL AX, old+8(FP)
+    RET
+
+// HLETicketRelease hands the ticket lock val on from ticket to the next
+// ticket. If no other ticket was taken, the ticket is returned instead using
+// XRELEASE LOCK CMPXCHG, which restores the value val had before
+// HLETicketAcquire, so that the lock can be elided.
+// func HLETicketRelease(val *uint32, ticket uint32)
+TEXT ·HLETicketRelease(SB),NOPTR|NOSPLIT,$0-12
+    MOVQ val+0(FP), CX
+    MOVL ticket+8(FP), DX
+    ANDL $0xffff, DX
+    // Expect next == ticket+1 and owner == ticket in BX
+    MOVL DX, BX
+    INCL BX
+    SHLL $16, BX
+    ORL DX, BX
+    // Return to next == owner == ticket in DX
+    MOVL DX, AX
+    SHLL $16, AX
+    ORL AX, DX
+    MOVL BX, AX
+    XRELEASE
+    LOCK
+    CMPXCHGL DX, (CX)
+    JEQ done
+    // Other tickets were taken, so serve the next one
+    LOCK
+    INCW (CX)
+done:
+    RET
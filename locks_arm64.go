@@ -0,0 +1,41 @@
+//go:build !race
+// +build !race
+
+package safetyfast
+
+// Pause executes the YIELD arm64 hint instruction.
+func Pause()
+
+// Mfence executes the DMB ISH arm64 instruction.
+func Mfence()
+
+// SetAndFence32 writes a 1 to val and asserts a DMB ISH.
+func SetAndFence32(val *int32)
+
+// Lock1XCHG8 will atomically write 1 to val while returning the old value.
+// The size of val must be 8 bits.
+func Lock1XCHG8(val *int8) (old int8)
+
+// Lock1XCHG32 will atomically write 1 to val while returning the old value.
+// The size of val must be 32 bits.
+func Lock1XCHG32(val *int32) (old int32)
+
+// Lock1XCHG64 will atomically write 1 to val while returning the old value.
+// The size of val must be 64 bits.
+func Lock1XCHG64(val *int64) (old int64)
+
+// SpinLock implements a basic spin lock that waits forever until the lock
+// can be acquired.
+// It assumes the lock has been acquired when it successfully writes a 1 to val,
+// while the original value was 0.
+// This implementation waits with the WFE instruction, so it does not
+// repeatedly hammer the lock's cache line while the lock is held.
+func SpinLock(val *int32)
+
+// SpinCountLock implements a basic spin lock that tries to acquire the lock
+// only attempts times.
+// It assumes the lock has been acquired when it successfully writes a 1 to val,
+// while the original value was 0.
+// This implementation spins on a read only and then atomically swaps in a 1
+// in order to claim the lock. The loop makes use of the YIELD hint instruction.
+func SpinCountLock(val, attempts *int32)
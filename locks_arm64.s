@@ -0,0 +1,136 @@
+//go:build !race
+// +build !race
+
+// When built with GOARM64=v8.1 or later, the LSE atomic instructions are used
+// to claim a lock. Otherwise, the LDAXR/STLXR exclusive pair is used.
+
+#include "textflag.h"
+
+// func Pause()
+TEXT ·Pause(SB),NOPTR|NOSPLIT,$0-0
+    YIELD
+    RET
+
+// func Mfence()
+TEXT ·Mfence(SB),NOPTR|NOSPLIT,$0-0
+    DMB $0xb // ISH
+    RET
+
+// SetAndFence32 writes a 1 to val and asserts a DMB.
+// func SetAndFence32(val *int32)
+TEXT ·SetAndFence32(SB),NOPTR|NOSPLIT,$0-8
+    MOVD val+0(FP), R0
+    MOVW $1, R1
+    MOVW R1, (R0)
+    DMB $0xb // ISH
+    RET
+
+// Atomically write 1 to val while returning the old value.
+// func Lock1XCHG8(val *int8) (old int8)
+TEXT ·Lock1XCHG8(SB),NOPTR|NOSPLIT,$0-9
+    MOVD val+0(FP), R0
+    MOVW $1, R1
+#ifdef GOARM64_LSE
+    SWPALB R1, (R0), R2
+#else
+retry:
+    LDAXRB (R0), R2
+    STLXRB R1, (R0), R3
+    CBNZW R3, retry
+#endif
+    MOVB R2, old+8(FP)
+    RET
+
+// Atomically write 1 to val while returning the old value.
+// func Lock1XCHG32(val *int32) (old int32)
+TEXT ·Lock1XCHG32(SB),NOPTR|NOSPLIT,$0-12
+    MOVD val+0(FP), R0
+    MOVW $1, R1
+#ifdef GOARM64_LSE
+    SWPALW R1, (R0), R2
+#else
+retry:
+    LDAXRW (R0), R2
+    STLXRW R1, (R0), R3
+    CBNZW R3, retry
+#endif
+    MOVW R2, old+8(FP)
+    RET
+
+// Atomically write 1 to val while returning the old value.
+// func Lock1XCHG64(val *int64) (old int64)
+TEXT ·Lock1XCHG64(SB),NOPTR|NOSPLIT,$0-16
+    MOVD val+0(FP), R0
+    MOVD $1, R1
+#ifdef GOARM64_LSE
+    SWPALD R1, (R0), R2
+#else
+retry:
+    LDAXR (R0), R2
+    STLXR R1, (R0), R3
+    CBNZW R3, retry
+#endif
+    MOVD R2, old+8(FP)
+    RET
+
+// SpinLock implements a basic spin lock that waits forever until the lock
+// can be acquired.
+// It assumes the lock has been acquired when it successfully writes a 1 to val,
+// while the original value was 0.
+// This implementation spins on an exclusive read, while waiting with WFE for
+// the holder's release to clear the exclusive monitor.
+// func SpinLock(val *int32)
+TEXT ·SpinLock(SB),NOPTR|NOSPLIT,$0-8
+    MOVD val+0(FP), R0
+    MOVW $1, R1
+    // Make sure the first WFE falls through
+    SEVL
+wait:
+    WFE
+tryread:
+    LDAXRW (R0), R2
+    CBNZW R2, wait
+#ifdef GOARM64_LSE
+    SWPALW R1, (R0), R2
+    CBNZW R2, tryread
+#else
+    STLXRW R1, (R0), R3
+    CBNZW R3, tryread
+#endif
+    RET
+
+// SpinCountLock implements a basic spin lock that tries to acquire the lock
+// only attempts times.
+// It assumes the lock has been acquired when it successfully writes a 1 to val,
+// while the original value was 0.
+// This implementation spins on a read only and then atomically swaps in a 1
+// in order to claim the lock. The loop makes use of the YIELD hint instruction.
+// func SpinCountLock(val, attempts *int32)
+TEXT ·SpinCountLock(SB),NOPTR|NOSPLIT,$0-16
+    MOVD val+0(FP), R0
+    // Load attempt counter in R5
+    MOVD attempts+8(FP), R4
+    MOVW (R4), R5
+    MOVW $1, R1
+tryread:
+#ifdef GOARM64_LSE
+    MOVW (R0), R2
+    CBNZW R2, spin
+    SWPALW R1, (R0), R2
+    CBNZW R2, tryread
+#else
+    LDAXRW (R0), R2
+    CBNZW R2, spin
+    STLXRW R1, (R0), R3
+    CBNZW R3, tryread
+#endif
+    B done
+spin:
+    YIELD
+    SUBSW $1, R5
+    // If R5 != 0, try again
+    BNE tryread
+done:
+    // Write back attempt counter
+    MOVW R5, (R4)
+    RET
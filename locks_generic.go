@@ -0,0 +1,117 @@
+//go:build (!386 && !amd64 && !arm64) || race
+// +build !386,!amd64,!arm64 race
+
+// This file provides a portable implementation of the lock primitives for
+// architectures that do not have a native assembly implementation.
+// It is built purely on sync/atomic, so it is also used when building with the
+// race detector, which can not see the synchronization done in assembly.
+
+package safetyfast
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// Pause is a hint that the caller is in a spin loop.
+// There is no portable spin hint instruction, so this is a no-op.
+//
+//go:noinline
+func Pause() {}
+
+// fence is the shared word that Mfence updates atomically.
+var fence int32
+
+// Mfence asserts a full memory barrier.
+// Go's memory model only orders atomic operations with each other, so this
+// is an atomic add on a shared word, which is sequentially consistent with
+// all other sync/atomic operations and orders the plain accesses around it
+// like any other atomic operation does.
+func Mfence() {
+	atomic.AddInt32(&fence, 1)
+}
+
+// SetAndFence32 writes a 1 to val and asserts a full memory barrier.
+func SetAndFence32(val *int32) {
+	atomic.StoreInt32(val, 1)
+}
+
+// bigEndian indicates if the byte order of the host is big endian.
+// It is needed to locate an 8 bit value within its enclosing 32 bit word.
+var bigEndian = func() bool {
+	x := uint32(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 0
+}()
+
+// Lock1XCHG8 will atomically write 1 to val while returning the old value.
+// The size of val must be 8 bits.
+// Since sync/atomic has no 8 bit operations, this is emulated with a
+// compare and swap on the aligned 32 bit word that contains val.
+func Lock1XCHG8(val *int8) (old int8) {
+	word := (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(val)) &^ 3))
+	shift := (uintptr(unsafe.Pointer(val)) & 3) * 8
+	if bigEndian {
+		shift = 24 - shift
+	}
+	mask := uint32(0xFF) << shift
+	for {
+		w := atomic.LoadUint32(word)
+		if atomic.CompareAndSwapUint32(word, w, (w&^mask)|(1<<shift)) {
+			return int8(w >> shift)
+		}
+	}
+}
+
+// Lock1XCHG32 will atomically write 1 to val while returning the old value.
+// The size of val must be 32 bits.
+func Lock1XCHG32(val *int32) (old int32) {
+	return atomic.SwapInt32(val, 1)
+}
+
+// Lock1XCHG64 will atomically write 1 to val while returning the old value.
+// The size of val must be 64 bits.
+// On 32 bit architectures, val must be 64 bit aligned.
+func Lock1XCHG64(val *int64) (old int64) {
+	return atomic.SwapInt64(val, 1)
+}
+
+// SpinLock implements a basic spin lock that waits forever until the lock
+// can be acquired.
+// It assumes the lock has been acquired when it successfully writes a 1 to val,
+// while the original value was 0.
+// This implementation spins on a read only and then uses an atomic swap
+// in order to claim the lock.
+func SpinLock(val *int32) {
+	for {
+		for atomic.LoadInt32(val) != 0 {
+			Pause()
+		}
+		if atomic.SwapInt32(val, 1) == 0 {
+			return
+		}
+	}
+}
+
+// SpinCountLock implements a basic spin lock that tries to acquire the lock
+// only attempts times.
+// It assumes the lock has been acquired when it successfully writes a 1 to val,
+// while the original value was 0.
+// This implementation spins on a read only and then uses an atomic swap
+// in order to claim the lock.
+func SpinCountLock(val, attempts *int32) {
+	n := *attempts
+	for {
+		if atomic.LoadInt32(val) == 0 {
+			if atomic.SwapInt32(val, 1) == 0 {
+				break
+			}
+			continue
+		}
+		Pause()
+		n--
+		if n == 0 {
+			break
+		}
+	}
+	*attempts = n
+}
@@ -1,8 +1,11 @@
 package safetyfast
 
 import (
+	"context"
 	"math/rand"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -18,6 +21,25 @@ func TestLock1XCHG8(t *testing.T) {
 	}
 }
 
+func TestLock1XCHG8Neighbors(t *testing.T) {
+	var x [8]int8
+	for i := range x {
+		ret := Lock1XCHG8(&x[i])
+		if ret != 0 {
+			t.Errorf("LockXCHG returned %v instead of 0 for index %d", ret, i)
+		}
+		for j := range x {
+			var expected int8
+			if j <= i {
+				expected = 1
+			}
+			if x[j] != expected {
+				t.Errorf("LockXCHG of index %d set index %d to %v instead of %v", i, j, x[j], expected)
+			}
+		}
+	}
+}
+
 func TestLock1XCHG32(t *testing.T) {
 	var x int32
 	ret := Lock1XCHG32(&x)
@@ -40,6 +62,42 @@ func TestLock1XCHG64(t *testing.T) {
 	}
 }
 
+func TestLock1XCHG64HighBits(t *testing.T) {
+	var x int64 = 0x7EADBEEF00000000
+	ret := Lock1XCHG64(&x)
+	if ret != 0x7EADBEEF00000000 {
+		t.Errorf("LockXCHG returned %#x instead of %#x", ret, int64(0x7EADBEEF00000000))
+	}
+	if x != 1 {
+		t.Errorf("LockXCHG set x to %v instead of 1", x)
+	}
+}
+
+func TestSpinCountLock(t *testing.T) {
+	var x int32
+	t.Run("Unlocked", func(t *testing.T) {
+		attempts := int32(10)
+		SpinCountLock(&x, &attempts)
+		if attempts != 10 {
+			t.Errorf("SpinCountLock set attempts to %v instead of 10", attempts)
+		}
+		if x != 1 {
+			t.Errorf("SpinCountLock set x to %v instead of 1", x)
+		}
+	})
+	t.Run("Locked", func(t *testing.T) {
+		x = 1
+		attempts := int32(10)
+		SpinCountLock(&x, &attempts)
+		if attempts != 0 {
+			t.Errorf("SpinCountLock set attempts to %v instead of 0", attempts)
+		}
+		if x != 1 {
+			t.Errorf("SpinCountLock set x to %v instead of 1", x)
+		}
+	})
+}
+
 func TestHLELock(t *testing.T) {
 	var x int32
 	t.Run("Default", func(t *testing.T) {
@@ -108,8 +166,8 @@ func TestHLESpinLock(t *testing.T) {
 			delayMS := r.Int31n(250)
 			time.Sleep(time.Millisecond * time.Duration(delayMS))
 			released = true
-			// definitely race - but minimal test
-			x = 0
+			// Release with a store the race detector can order
+			HLEUnlock(&x)
 		}()
 
 		HLESpinLock(&x)
@@ -127,3 +185,283 @@ func TestHLESpinLock(t *testing.T) {
 		runtime.GOMAXPROCS(oldmaxprocs)
 	})
 }
+
+func TestIsLocked(t *testing.T) {
+	run := func(t *testing.T, lock interface {
+		sync.Locker
+		LockStateReader
+	}) {
+		if lock.IsLocked() {
+			t.Error("IsLocked reported true for a new lock")
+		}
+		lock.Lock()
+		if !lock.IsLocked() {
+			t.Error("IsLocked reported false for a held lock")
+		}
+		lock.Unlock()
+		if lock.IsLocked() {
+			t.Error("IsLocked reported true for a released lock")
+		}
+	}
+
+	t.Run("SpinMutex", func(t *testing.T) {
+		run(t, new(SpinMutex))
+	})
+
+	t.Run("SpinMutexASM", func(t *testing.T) {
+		run(t, new(SpinMutexASM))
+	})
+
+	t.Run("SpinMutexBasic", func(t *testing.T) {
+		run(t, new(SpinMutexBasic))
+	})
+
+	t.Run("SpinHLEMutex", func(t *testing.T) {
+		run(t, new(SpinHLEMutex))
+	})
+
+	t.Run("SpinTicketMutex", func(t *testing.T) {
+		run(t, new(SpinTicketMutex))
+	})
+
+	t.Run("SpinHLETicketMutex", func(t *testing.T) {
+		run(t, new(SpinHLETicketMutex))
+	})
+
+	t.Run("MCSMutex", func(t *testing.T) {
+		run(t, new(MCSMutex))
+	})
+
+	t.Run("AdaptiveMutex", func(t *testing.T) {
+		run(t, new(AdaptiveMutex))
+	})
+}
+
+// deadlineLocker is a mutex that can give up on acquiring the lock.
+type deadlineLocker interface {
+	TryLocker
+	LockTimeout(d time.Duration) bool
+	LockContext(ctx context.Context) error
+}
+
+func TestDeadlineLockers(t *testing.T) {
+	run := func(t *testing.T, lock deadlineLocker) {
+		t.Run("TryLock", func(t *testing.T) {
+			if !lock.TryLock() {
+				t.Fatal("TryLock failed on a free lock")
+			}
+			if lock.TryLock() {
+				t.Error("TryLock succeeded on a held lock")
+			}
+			lock.Unlock()
+		})
+
+		t.Run("LockTimeout", func(t *testing.T) {
+			if !lock.LockTimeout(time.Millisecond) {
+				t.Fatal("LockTimeout failed on a free lock")
+			}
+			start := time.Now()
+			if lock.LockTimeout(10 * time.Millisecond) {
+				t.Error("LockTimeout succeeded on a held lock")
+			}
+			if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+				t.Errorf("LockTimeout gave up after %v instead of 10ms", elapsed)
+			}
+
+			// The lock is released while waiting
+			go func() {
+				time.Sleep(5 * time.Millisecond)
+				lock.Unlock()
+			}()
+			if !lock.LockTimeout(time.Minute) {
+				t.Error("LockTimeout failed on a lock that was released")
+			}
+			lock.Unlock()
+		})
+
+		t.Run("LockContext", func(t *testing.T) {
+			if err := lock.LockContext(context.Background()); err != nil {
+				t.Fatalf("LockContext failed on a free lock with %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if err := lock.LockContext(ctx); err != context.DeadlineExceeded {
+				t.Errorf("LockContext returned %v on a held lock instead of %v", err, context.DeadlineExceeded)
+			}
+			lock.Unlock()
+
+			canceled, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := lock.LockContext(canceled); err != context.Canceled {
+				t.Errorf("LockContext returned %v on a canceled context instead of %v", err, context.Canceled)
+			}
+			if !lock.TryLock() {
+				t.Error("LockContext acquired the lock with a canceled context")
+			}
+			lock.Unlock()
+		})
+	}
+
+	t.Run("SpinMutex", func(t *testing.T) {
+		run(t, new(SpinMutex))
+	})
+
+	t.Run("SpinMutexASM", func(t *testing.T) {
+		run(t, new(SpinMutexASM))
+	})
+
+	t.Run("SpinMutexBasic", func(t *testing.T) {
+		run(t, new(SpinMutexBasic))
+	})
+
+	t.Run("SpinHLEMutex", func(t *testing.T) {
+		run(t, new(SpinHLEMutex))
+	})
+
+	t.Run("ElidedMutex", func(t *testing.T) {
+		run(t, new(ElidedMutex))
+	})
+
+	t.Run("SpinTicketMutex", func(t *testing.T) {
+		run(t, new(SpinTicketMutex))
+	})
+
+	t.Run("SpinHLETicketMutex", func(t *testing.T) {
+		run(t, new(SpinHLETicketMutex))
+	})
+
+	t.Run("SpinRWMutex", func(t *testing.T) {
+		run(t, new(SpinRWMutex))
+	})
+
+	t.Run("ElidedRWMutex", func(t *testing.T) {
+		run(t, new(ElidedRWMutex))
+	})
+
+	t.Run("MCSMutex", func(t *testing.T) {
+		run(t, new(MCSMutex))
+	})
+
+	t.Run("AdaptiveMutex", func(t *testing.T) {
+		run(t, new(AdaptiveMutex))
+	})
+}
+
+func TestTicketMutexFIFO(t *testing.T) {
+	run := func(t *testing.T, lock sync.Locker, tickets func() uint32) {
+		const numWaiters = 8
+
+		// A waiter whose thread the OS preempted stalls all later tickets,
+		// so do not run more threads than CPUs
+		oldmaxprocs := runtime.GOMAXPROCS(runtime.NumCPU())
+
+		var wg sync.WaitGroup
+		var order []int
+		lock.Lock()
+		for i := 0; i < numWaiters; i++ {
+			taken := tickets()
+			wg.Add(1)
+			go func(i int) {
+				lock.Lock()
+				order = append(order, i)
+				lock.Unlock()
+				wg.Done()
+			}(i)
+			// Only start the next waiter once this one holds its ticket
+			for tickets() == taken {
+				runtime.Gosched()
+			}
+		}
+		lock.Unlock()
+		wg.Wait()
+
+		for i, v := range order {
+			if v != i {
+				t.Fatalf("Waiters acquired the lock in order %v instead of FIFO", order)
+			}
+		}
+
+		runtime.GOMAXPROCS(oldmaxprocs)
+	}
+
+	t.Run("SpinTicketMutex", func(t *testing.T) {
+		var m SpinTicketMutex
+		run(t, &m, func() uint32 {
+			return atomic.LoadUint32(&m.next)
+		})
+	})
+
+	t.Run("SpinHLETicketMutex", func(t *testing.T) {
+		var m SpinHLETicketMutex
+		run(t, &m, func() uint32 {
+			return atomic.LoadUint32((*uint32)(&m)) >> 16
+		})
+	})
+}
+
+func TestTicketMutexContention(t *testing.T) {
+	run := func(t *testing.T, lock sync.Locker) {
+		const numConcurGoRoutines = 4
+		const numIterations = 200000 / raceScale
+
+		// A waiter whose thread the OS preempted stalls all later tickets,
+		// so do not run more threads than CPUs
+		oldmaxprocs := runtime.GOMAXPROCS(runtime.NumCPU())
+
+		var wg sync.WaitGroup
+		var counter int
+		wg.Add(numConcurGoRoutines)
+		for i := 0; i < numConcurGoRoutines; i++ {
+			go func() {
+				for i := 0; i < numIterations; i++ {
+					lock.Lock()
+					counter++
+					lock.Unlock()
+				}
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+
+		if expected := numIterations * numConcurGoRoutines; counter != expected {
+			t.Fatalf("Counter is %d, but we expected %d", counter, expected)
+		}
+
+		runtime.GOMAXPROCS(oldmaxprocs)
+	}
+
+	t.Run("SpinTicketMutex", func(t *testing.T) {
+		run(t, new(SpinTicketMutex))
+	})
+
+	t.Run("SpinHLETicketMutex", func(t *testing.T) {
+		run(t, new(SpinHLETicketMutex))
+	})
+}
+
+func TestHLETicketWraparound(t *testing.T) {
+	// Both halves are about to wrap around
+	m := SpinHLETicketMutex(0xffff<<16 | 0xffff)
+	m.Lock()
+	if !m.IsLocked() {
+		t.Fatal("IsLocked reported false for a held lock")
+	}
+	m.Unlock()
+	if m.IsLocked() {
+		t.Fatalf("Unlock left the lock held with value %#x", uint32(m))
+	}
+
+	// A second ticket is waiting, so the owner must wrap without carrying
+	// into the next ticket
+	m = SpinHLETicketMutex(0xffff<<16 | 0xffff)
+	m.Lock()
+	HLETicketAcquire((*uint32)(&m))
+	m.Unlock()
+	if uint32(m) != 1<<16 {
+		t.Fatalf("Unlock set the lock to %#x instead of %#x", uint32(m), 1<<16)
+	}
+	m.Unlock()
+	if m.IsLocked() {
+		t.Fatalf("Unlock left the lock held with value %#x", uint32(m))
+	}
+}
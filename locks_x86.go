@@ -1,12 +1,9 @@
+//go:build (386 || amd64) && !race
 // +build 386 amd64
+// +build !race
 
 package safetyfast
 
-import (
-	"runtime"
-	"sync/atomic"
-)
-
 // Pause executes the PAUSE x86 instruction.
 func Pause()
 
@@ -70,107 +67,16 @@ func HLESpinCountLock(val, attempts *int32)
 // using HLE primitives
 func HLEUnlock(val *int32)
 
-// LockAttempts sets how many times the spin loop is willing to try to
-// fetching the lock.
-const LockAttempts = int32(200)
-
-// SpinLockAtomics implements a very basic spin forever style lock that
-// uses the built in atomics.SwapInt32 function in order to claim the lock.
-func SpinLockAtomics(val *int32) {
-	for {
-		// Spin on simple read
-		for *val != 0 {
-			// ASM hint for spin loop
-			Pause()
-		}
-		if atomic.SwapInt32(val, 1) == 0 {
-			break
-		}
-	}
-}
-
-type SpinMutexBasic struct {
-	val int32
-}
-
-func (m *SpinMutexBasic) Lock() {
-	for !atomic.CompareAndSwapInt32(&m.val, 0, 1) {
-		Pause()
-	}
-}
-
-func (m *SpinMutexBasic) Unlock() {
-	m.val = 0
-}
-
-type SpinMutex int32
-
-// Fastest
-func (m *SpinMutex) Lock() {
-	for {
-		var attempts int32 = LockAttempts
-		SpinCountLock((*int32)(m), &attempts)
-		if attempts > 0 {
-			// We acquired the lock before attempts was exceeded
-			return
-		}
-		// Invoke scheduler to allow other to run
-		runtime.Gosched()
-	}
-}
-
-func (m *SpinMutex) Unlock() {
-	*m = 0
-}
-
-func (m *SpinMutex) IsLocked() bool {
-	return *m == 1
-}
-
-type SpinMutexASM int32
-
-func (m *SpinMutexASM) Lock() {
-	for {
-		// Spin on simple read
-		for *m != 0 {
-			// ASM hint for spin loop
-			Pause()
-		}
-		if Lock1XCHG32((*int32)(m)) == 0 {
-			break
-		}
-	}
-	// for atomic.SwapInt32(&m.val, 1) != 0 {
-	// 	// Spin on simple read
-	// 	for m.val != 0 {
-	// 		// ASM hint for spin loop
-	// 		Pause()
-	// 	}
-	// }
-}
-
-func (m *SpinMutexASM) Unlock() {
-	*m = 0
-}
-
-// SpinHLEMutex is sync.Mutex replacement that uses HLE
-type SpinHLEMutex int32
-
-func (m *SpinHLEMutex) Lock() {
-	// HLESpinLock((*int32)(m))
-	for {
-		var attempts int32 = LockAttempts
-		HLESpinCountLock((*int32)(m), &attempts)
-
-		if attempts > 0 {
-			// We acquired the lock before attempts was exceeded
-			return
-		}
-		// Invoke scheduler to allow other to run
-		runtime.Gosched()
-	}
-}
-
-func (m *SpinHLEMutex) Unlock() {
-	HLEUnlock((*int32)(m))
-}
+// HLETicketAcquire takes the next ticket of the ticket lock val using
+// XACQUIRE LOCK XADD, and returns the old value of val.
+// The upper 16 bits of val hold the next ticket to hand out, and the lower
+// 16 bits hold the ticket that owns the lock, so the ticket taken is
+// old>>16, and the lock is acquired once the lower bits of val match it.
+func HLETicketAcquire(val *uint32) (old uint32)
+
+// HLETicketRelease hands the ticket lock val on from ticket, which must own
+// the lock, to the next ticket.
+// If no other ticket was taken since ticket, it is returned instead using
+// XRELEASE LOCK CMPXCHG, which restores the value val had before
+// HLETicketAcquire. This allows an uncontended lock to be elided.
+func HLETicketRelease(val *uint32, ticket uint32)
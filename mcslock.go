@@ -0,0 +1,173 @@
+package safetyfast
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// MCSNode is a waiter's entry in the queue of an MCSLock.
+// Each goroutine that holds or waits for the lock needs its own node, and
+// spins only on the node's own cache line. A node can be reused for any
+// MCSLock once Unlock returned, but must not be copied while in use.
+type MCSNode struct {
+	// Keep the previous allocation out of the cache lines of the hot fields,
+	// so that writes to it do not disturb this node's spin
+	_ [128]byte
+	// next points to the MCSNode of the waiter queued behind this one
+	next unsafe.Pointer
+	// locked is cleared by the previous holder to hand over the lock
+	locked uint32
+	// Keep the next allocation out of the same cache lines
+	_ [128]byte
+}
+
+// MCSLock is a fair queue lock, as described by Mellor-Crummey and Scott.
+// Waiters enqueue their MCSNode using a single swap of the tail, and each
+// waiter spins on its own node until its predecessor hands the lock over.
+// Unlike SpinMutex and SpinTicketMutex, a release only writes to the next
+// waiter's node, so contention does not cause a coherence storm on a
+// shared cache line. Waiters acquire the lock in FIFO order.
+//
+// The zero value is an unlocked lock. MCSMutex wraps an MCSLock as a
+// sync.Locker that manages the nodes.
+type MCSLock struct {
+	// tail points to the MCSNode of the last waiter, or is nil if the lock
+	// is free
+	tail unsafe.Pointer
+}
+
+// mcsWait spins until the holder of the lock before n hands it over.
+func mcsWait(n *MCSNode) {
+	attempts := LockAttempts
+	for atomic.LoadUint32(&n.locked) != 0 {
+		Pause()
+		if attempts--; attempts == 0 {
+			attempts = LockAttempts
+			// Invoke scheduler to allow the holder to run
+			runtime.Gosched()
+		}
+	}
+}
+
+// Lock acquires the lock, using n as the caller's queue entry.
+// The same n must be passed to Unlock.
+func (l *MCSLock) Lock(n *MCSNode) {
+	atomic.StorePointer(&n.next, nil)
+	atomic.StoreUint32(&n.locked, 1)
+	pred := (*MCSNode)(atomic.SwapPointer(&l.tail, unsafe.Pointer(n)))
+	if pred == nil {
+		return
+	}
+	atomic.StorePointer(&pred.next, unsafe.Pointer(n))
+	mcsWait(n)
+}
+
+// TryLock acquires the lock only if no other node holds or waits for it,
+// using n as the caller's queue entry, and reports if it succeeded.
+func (l *MCSLock) TryLock(n *MCSNode) bool {
+	atomic.StorePointer(&n.next, nil)
+	return atomic.CompareAndSwapPointer(&l.tail, nil, unsafe.Pointer(n))
+}
+
+// Unlock releases the lock acquired using n, and hands it over to the next
+// waiter, if any.
+func (l *MCSLock) Unlock(n *MCSNode) {
+	next := (*MCSNode)(atomic.LoadPointer(&n.next))
+	if next == nil {
+		if atomic.CompareAndSwapPointer(&l.tail, unsafe.Pointer(n), nil) {
+			return
+		}
+		// A waiter already swapped itself in as the tail, but has not
+		// linked itself to n yet
+		attempts := LockAttempts
+		for next == nil {
+			Pause()
+			if attempts--; attempts == 0 {
+				attempts = LockAttempts
+				// Invoke scheduler to allow the waiter to run
+				runtime.Gosched()
+			}
+			next = (*MCSNode)(atomic.LoadPointer(&n.next))
+		}
+	}
+	atomic.StoreUint32(&next.locked, 0)
+}
+
+// IsLocked reports if the lock is held.
+func (l *MCSLock) IsLocked() bool {
+	return atomic.LoadPointer(&l.tail) != nil
+}
+
+// mcsNodes holds the nodes of MCSMutex between uses.
+var mcsNodes = sync.Pool{
+	New: func() interface{} {
+		return new(MCSNode)
+	},
+}
+
+// MCSMutex is a sync.Mutex replacement based on MCSLock.
+// The queue nodes are taken from a pool on Lock and returned on Unlock, so
+// callers do not need to manage them. Where the pool is too costly, use an
+// MCSLock with a node per goroutine instead.
+// As with SpinTicketMutex, a descheduled waiter delays all waiters behind
+// it, so GOMAXPROCS should be no larger than the number of CPUs.
+type MCSMutex struct {
+	lock MCSLock
+	// holder is the node that holds the lock. It is only accessed by the
+	// goroutine holding the lock.
+	holder *MCSNode
+}
+
+func (m *MCSMutex) Lock() {
+	n := mcsNodes.Get().(*MCSNode)
+	m.lock.Lock(n)
+	m.holder = n
+}
+
+// TryLock acquires the lock only if no other goroutine holds or waits for
+// it, and reports if it succeeded.
+func (m *MCSMutex) TryLock() bool {
+	n := mcsNodes.Get().(*MCSNode)
+	if !m.lock.TryLock(n) {
+		mcsNodes.Put(n)
+		return false
+	}
+	m.holder = n
+	return true
+}
+
+// LockTimeout acquires the lock, unless it could not be acquired within d.
+// It reports if the lock was acquired.
+// The lock is only acquired while it is free, so unlike Lock, LockTimeout
+// does not wait in line and may wait longer than later calls to Lock.
+func (m *MCSMutex) LockTimeout(d time.Duration) bool {
+	return lockTimeout(func() bool {
+		return tryLockRound(m.TryLock)
+	}, d)
+}
+
+// LockContext acquires the lock, unless ctx is done first, in which case
+// it returns the context's error.
+// The lock is only acquired while it is free, so unlike Lock, LockContext
+// does not wait in line and may wait longer than later calls to Lock.
+func (m *MCSMutex) LockContext(ctx context.Context) error {
+	return lockContext(func() bool {
+		return tryLockRound(m.TryLock)
+	}, ctx)
+}
+
+func (m *MCSMutex) Unlock() {
+	n := m.holder
+	m.holder = nil
+	m.lock.Unlock(n)
+	mcsNodes.Put(n)
+}
+
+// IsLocked reports if the lock is held.
+func (m *MCSMutex) IsLocked() bool {
+	return m.lock.IsLocked()
+}
@@ -0,0 +1,125 @@
+package safetyfast
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+func TestMCSLock(t *testing.T) {
+	var l MCSLock
+	var a, b MCSNode
+
+	if l.IsLocked() {
+		t.Error("IsLocked reported true for a new lock")
+	}
+	l.Lock(&a)
+	if !l.IsLocked() {
+		t.Error("IsLocked reported false for a held lock")
+	}
+	if l.TryLock(&b) {
+		t.Error("TryLock succeeded on a held lock")
+	}
+	l.Unlock(&a)
+	if l.IsLocked() {
+		t.Error("IsLocked reported true for a released lock")
+	}
+
+	// Nodes can be reused once released
+	if !l.TryLock(&a) {
+		t.Fatal("TryLock failed on a free lock")
+	}
+	l.Unlock(&a)
+}
+
+func TestMCSLockHandover(t *testing.T) {
+	var l MCSLock
+	var a, b MCSNode
+
+	oldmaxprocs := runtime.GOMAXPROCS(runtime.NumCPU())
+
+	l.Lock(&a)
+	acquired := make(chan struct{})
+	go func() {
+		l.Lock(&b)
+		close(acquired)
+	}()
+	// Wait until b is queued behind a
+	for atomic.LoadPointer(&l.tail) != unsafe.Pointer(&b) {
+		runtime.Gosched()
+	}
+	select {
+	case <-acquired:
+		t.Fatal("A waiter acquired the held lock")
+	default:
+	}
+	l.Unlock(&a)
+	<-acquired
+	if !l.IsLocked() {
+		t.Error("IsLocked reported false after the lock was handed over")
+	}
+	l.Unlock(&b)
+	if l.IsLocked() {
+		t.Error("IsLocked reported true for a released lock")
+	}
+
+	runtime.GOMAXPROCS(oldmaxprocs)
+}
+
+func TestMCSContention(t *testing.T) {
+	const numConcurGoRoutines = 4
+	const numIterations = 200000 / raceScale
+
+	// A waiter whose thread the OS preempted stalls all later waiters, so
+	// do not run more threads than CPUs
+	oldmaxprocs := runtime.GOMAXPROCS(runtime.NumCPU())
+
+	t.Run("MCSLock", func(t *testing.T) {
+		var l MCSLock
+		var wg sync.WaitGroup
+		var counter int
+		wg.Add(numConcurGoRoutines)
+		for i := 0; i < numConcurGoRoutines; i++ {
+			go func() {
+				var n MCSNode
+				for i := 0; i < numIterations; i++ {
+					l.Lock(&n)
+					counter++
+					l.Unlock(&n)
+				}
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+
+		if expected := numIterations * numConcurGoRoutines; counter != expected {
+			t.Fatalf("Counter is %d, but we expected %d", counter, expected)
+		}
+	})
+
+	t.Run("MCSMutex", func(t *testing.T) {
+		var m MCSMutex
+		var wg sync.WaitGroup
+		var counter int
+		wg.Add(numConcurGoRoutines)
+		for i := 0; i < numConcurGoRoutines; i++ {
+			go func() {
+				for i := 0; i < numIterations; i++ {
+					m.Lock()
+					counter++
+					m.Unlock()
+				}
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+
+		if expected := numIterations * numConcurGoRoutines; counter != expected {
+			t.Fatalf("Counter is %d, but we expected %d", counter, expected)
+		}
+	})
+
+	runtime.GOMAXPROCS(oldmaxprocs)
+}
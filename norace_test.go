@@ -0,0 +1,8 @@
+//go:build !race
+// +build !race
+
+package safetyfast
+
+// raceScale divides the iteration counts of the concurrency tests.
+// Without the race detector, the tests run at full size.
+const raceScale = 1
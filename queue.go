@@ -0,0 +1,159 @@
+package safetyfast
+
+import "runtime"
+
+// Queue is a bounded multi-producer multi-consumer FIFO queue.
+// Each enqueue and dequeue runs as a single atomic section of its context,
+// which updates the head, the tail, and the slot together.
+// When the context uses RTM, uncontended operations never write to a shared
+// lock, so they cost about as much as an elided lock.
+type Queue[T any] struct {
+	ctx AtomicContext
+	buf []T
+	// head is the number of values dequeued so far
+	head uint64
+	// tail is the number of values enqueued so far
+	tail uint64
+}
+
+// NewQueue creates a Queue that holds up to capacity values, using
+// NewAutoContext. When RTM is not available, the queue is protected by a
+// SpinMutex.
+func NewQueue[T any](capacity int) *Queue[T] {
+	return NewQueueContext[T](capacity, NewAutoContext())
+}
+
+// NewQueueContext creates a Queue that holds up to capacity values, using c
+// to run its operations atomically.
+func NewQueueContext[T any](capacity int, c AtomicContext) *Queue[T] {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Queue[T]{
+		ctx: c,
+		buf: make([]T, capacity),
+	}
+}
+
+// Cap returns the maximum number of values the queue can hold.
+func (q *Queue[T]) Cap() int {
+	return len(q.buf)
+}
+
+// Len returns the number of values in the queue.
+func (q *Queue[T]) Len() int {
+	var n int
+	q.read(func() {
+		n = int(q.tail - q.head)
+	})
+	return n
+}
+
+// read executes reader atomically, with the read lock if the context
+// supports it.
+func (q *Queue[T]) read(reader func()) {
+	if rc, ok := q.ctx.(RWAtomicContext); ok {
+		rc.AtomicRead(reader)
+		return
+	}
+	q.ctx.Atomic(reader)
+}
+
+// TryEnqueue adds v to the tail of the queue, unless the queue is full.
+// It reports if v was added.
+func (q *Queue[T]) TryEnqueue(v T) bool {
+	var ok bool
+	q.ctx.Atomic(func() {
+		ok = q.tail-q.head < uint64(len(q.buf))
+		if ok {
+			q.buf[q.tail%uint64(len(q.buf))] = v
+			q.tail++
+		}
+	})
+	return ok
+}
+
+// TryDequeue removes the value at the head of the queue, unless the queue
+// is empty. It reports if a value was removed.
+func (q *Queue[T]) TryDequeue() (T, bool) {
+	var v T
+	var ok bool
+	q.ctx.Atomic(func() {
+		ok = q.tail != q.head
+		if ok {
+			slot := &q.buf[q.head%uint64(len(q.buf))]
+			v = *slot
+			// Do not keep the value alive from the queue
+			*slot = *new(T)
+			q.head++
+		}
+	})
+	return v, ok
+}
+
+// EnqueueBatch adds as many values from vs to the tail of the queue as
+// fit, in order, within a single atomic section. It returns the number of
+// values added.
+func (q *Queue[T]) EnqueueBatch(vs []T) int {
+	var n int
+	q.ctx.Atomic(func() {
+		n = len(q.buf) - int(q.tail-q.head)
+		if n > len(vs) {
+			n = len(vs)
+		}
+		for _, v := range vs[:n] {
+			q.buf[q.tail%uint64(len(q.buf))] = v
+			q.tail++
+		}
+	})
+	return n
+}
+
+// DequeueBatch removes up to len(dst) values from the head of the queue
+// into dst, in order, within a single atomic section. It returns the number
+// of values removed.
+func (q *Queue[T]) DequeueBatch(dst []T) int {
+	var n int
+	q.ctx.Atomic(func() {
+		n = int(q.tail - q.head)
+		if n > len(dst) {
+			n = len(dst)
+		}
+		for i := range dst[:n] {
+			slot := &q.buf[q.head%uint64(len(q.buf))]
+			dst[i] = *slot
+			*slot = *new(T)
+			q.head++
+		}
+	})
+	return n
+}
+
+// Enqueue adds v to the tail of the queue, waiting while the queue is full.
+func (q *Queue[T]) Enqueue(v T) {
+	for {
+		for attempts := LockAttempts; attempts > 0; attempts-- {
+			if q.TryEnqueue(v) {
+				return
+			}
+			Pause()
+		}
+		// Invoke scheduler to allow consumers to run
+		runtime.Gosched()
+	}
+}
+
+// Dequeue removes the value at the head of the queue, waiting while the
+// queue is empty.
+func (q *Queue[T]) Dequeue() T {
+	for {
+		for attempts := LockAttempts; attempts > 0; attempts-- {
+			if v, ok := q.TryDequeue(); ok {
+				return v
+			}
+			Pause()
+		}
+		// Invoke scheduler to allow producers to run
+		runtime.Gosched()
+	}
+}
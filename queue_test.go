@@ -0,0 +1,177 @@
+package safetyfast
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	q := NewQueue[int](4)
+	if q.Cap() != 4 || q.Len() != 0 {
+		t.Fatalf("New queue has Cap=%d Len=%d instead of 4 and 0", q.Cap(), q.Len())
+	}
+	if _, ok := q.TryDequeue(); ok {
+		t.Error("TryDequeue returned a value from an empty queue")
+	}
+	for i := 0; i < 4; i++ {
+		if !q.TryEnqueue(i) {
+			t.Fatalf("TryEnqueue failed on value %d", i)
+		}
+	}
+	if q.TryEnqueue(4) {
+		t.Error("TryEnqueue added a value to a full queue")
+	}
+	if q.Len() != 4 {
+		t.Errorf("Len returned %d instead of 4", q.Len())
+	}
+	for i := 0; i < 2; i++ {
+		if v, ok := q.TryDequeue(); !ok || v != i {
+			t.Errorf("TryDequeue returned %v, %v instead of %v, true", v, ok, i)
+		}
+	}
+
+	// The batch wraps around the end of the buffer, and only 2 values fit
+	if n := q.EnqueueBatch([]int{4, 5, 6}); n != 2 {
+		t.Errorf("EnqueueBatch added %d values instead of 2", n)
+	}
+	dst := make([]int, 8)
+	if n := q.DequeueBatch(dst); n != 4 {
+		t.Errorf("DequeueBatch removed %d values instead of 4", n)
+	}
+	for i, v := range dst[:4] {
+		if v != i+2 {
+			t.Errorf("DequeueBatch returned %d at index %d instead of %d", v, i, i+2)
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("Len returned %d instead of 0", q.Len())
+	}
+}
+
+func TestQueueReleasesValues(t *testing.T) {
+	q := NewQueue[*int](2)
+	q.Enqueue(new(int))
+	q.Dequeue()
+	for _, p := range q.buf {
+		if p != nil {
+			t.Error("Dequeue left a reference to the value in the queue")
+		}
+	}
+}
+
+func TestQueueConcurrent(t *testing.T) {
+	const numProducers = 4
+	const numConsumers = 4
+	const numIterations = 20000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numProducers + numConsumers)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	run := func(t *testing.T, q *Queue[int]) {
+		var producers, consumers sync.WaitGroup
+		sums := make([]int64, numConsumers)
+		counts := make([]int, numConsumers)
+
+		producers.Add(numProducers)
+		for p := 0; p < numProducers; p++ {
+			go func(p int) {
+				batch := make([]int, 0, 3)
+				for i := 1; i <= numIterations; i++ {
+					if p%2 == 0 {
+						q.Enqueue(i)
+						continue
+					}
+					// Odd producers enqueue in batches
+					batch = append(batch, i)
+					if len(batch) == cap(batch) || i == numIterations {
+						for vs := batch; len(vs) > 0; {
+							vs = vs[q.EnqueueBatch(vs):]
+							Pause()
+						}
+						batch = batch[:0]
+					}
+				}
+				producers.Done()
+			}(p)
+		}
+
+		done := make(chan struct{})
+		consumers.Add(numConsumers)
+		for c := 0; c < numConsumers; c++ {
+			go func(c int) {
+				dst := make([]int, 3)
+				for {
+					var n int
+					if c%2 == 0 {
+						if v, ok := q.TryDequeue(); ok {
+							dst[0], n = v, 1
+						}
+					} else {
+						n = q.DequeueBatch(dst)
+					}
+					for _, v := range dst[:n] {
+						sums[c] += int64(v)
+						counts[c]++
+					}
+					if n == 0 {
+						select {
+						case <-done:
+							if q.Len() == 0 {
+								consumers.Done()
+								return
+							}
+						default:
+							runtime.Gosched()
+						}
+					}
+				}
+			}(c)
+		}
+
+		producers.Wait()
+		close(done)
+		consumers.Wait()
+
+		var sum int64
+		var count int
+		for c := range sums {
+			sum += sums[c]
+			count += counts[c]
+		}
+		if expected := numProducers * numIterations; count != expected {
+			t.Fatalf("Dequeued %d values, but we expected %d", count, expected)
+		}
+		if expected := int64(numProducers * numIterations * (numIterations + 1) / 2); sum != expected {
+			t.Fatalf("Sum result is %d, but we expected %d", sum, expected)
+		}
+	}
+
+	t.Run("AutoContext", func(t *testing.T) {
+		run(t, NewQueue[int](64))
+	})
+
+	t.Run("SpinMutex", func(t *testing.T) {
+		run(t, NewQueueContext[int](64, NewLockedContext(new(SpinMutex))))
+	})
+
+	t.Run("Faults", func(t *testing.T) {
+		run(t, NewQueueContext[int](64, newRTMContextFaults(new(SpinMutex), faultSequence(AbortConflict))))
+	})
+}
+
+func TestQueueFIFO(t *testing.T) {
+	const numIterations = 100000 / raceScale
+
+	q := NewQueue[int](16)
+	go func() {
+		for i := 0; i < numIterations; i++ {
+			q.Enqueue(i)
+		}
+	}()
+	for i := 0; i < numIterations; i++ {
+		if v := q.Dequeue(); v != i {
+			t.Fatalf("Dequeue returned %d instead of %d", v, i)
+		}
+	}
+}
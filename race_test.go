@@ -0,0 +1,9 @@
+//go:build race
+// +build race
+
+package safetyfast
+
+// raceScale divides the iteration counts of the concurrency tests, since
+// the race detector slows down the contended lock paths by orders of
+// magnitude.
+const raceScale = 100
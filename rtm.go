@@ -1,4 +1,5 @@
-// +build amd64
+//go:build amd64 && !race
+// +build amd64,!race
 
 package safetyfast
 
@@ -12,61 +13,213 @@ import (
 // RTMContext holds the shared state for the fallback path if the RTM
 // transaction fails
 type RTMContext struct {
-	fallback       int32
-	lock           sync.Locker
-	capacityaborts uint64
+	// stats must be first, to be 64 bit aligned on 32 bit architectures
+	stats rtmStats
+	// fallback is set while the fallback path is in use, when lock is not
+	// a LockStateReader
+	fallback int32
+	// readers counts the readers on the fallback path, when lock is an
+	// RWLocker
+	readers int32
+	lock    sync.Locker
+	rlock   RWLocker
+	trylock TryLocker
+	state   LockStateReader
+	policy  rtmPolicy
 }
 
 // NewRTMContexDefault creates an AtomicContext that tries to use Intel RTM,
 // but can fallback to using the native sync.Mutex.
-func NewRTMContexDefault() *RTMContext {
-	return &RTMContext{
-		lock: new(sync.Mutex),
-	}
+// The retry policy can be tuned using opts.
+func NewRTMContexDefault(opts ...RTMOption) *RTMContext {
+	return NewRTMContex(new(sync.Mutex), opts...)
+}
+
+// NewRTMContexRW creates an RWAtomicContext that tries to use Intel RTM,
+// but can fallback to using the native sync.RWMutex.
+// Readers that fallback can still run concurrently with each other.
+// The retry policy can be tuned using opts.
+func NewRTMContexRW(opts ...RTMOption) *RTMContext {
+	return NewRTMContex(new(sync.RWMutex), opts...)
 }
 
 // NewRTMContex creates an AtomicContext that tries to use Intel RTM,
 // but can fallback to using the provided sync.Locker.
-func NewRTMContex(l sync.Locker) *RTMContext {
-	return &RTMContext{
-		lock: l,
+// If l is also an RWLocker, readers that fallback use the read lock.
+// If l is also a LockStateReader, transactions read the lock's state
+// directly, instead of a separate fallback flag.
+// The retry policy can be tuned using opts.
+func NewRTMContex(l sync.Locker, opts ...RTMOption) *RTMContext {
+	r := &RTMContext{
+		lock:   l,
+		policy: newRTMPolicy(opts),
 	}
+	r.rlock, _ = l.(RWLocker)
+	r.trylock, _ = l.(TryLocker)
+	r.state, _ = l.(LockStateReader)
+	return r
 }
 
-// CapacityAborts returns the number of aborts that were due to cache capacity.
-// If you see lots of capacity aborts, this means the commiter function
-// if touching too many memory locations and is unlikely to be reaping any gains
-// from using an RTMContext.
-func (r *RTMContext) CapacityAborts() uint64 {
-	return r.capacityaborts
+// fallbackHeld reports if a writer is using the fallback path.
+// When called within a transaction, the state read becomes part of the
+// transaction, so the transaction aborts when a writer takes the fallback path.
+func (r *RTMContext) fallbackHeld() bool {
+	if r.state != nil {
+		return r.state.IsLocked()
+	}
+	return r.fallback != 0
 }
 
-// Atomic executes the commiter in an atomic fasion.
+// enterFallback marks the fallback path as in use, after the fallback lock
+// has been acquired. When the lock's state is read directly, acquiring the
+// lock was already enough.
+func (r *RTMContext) enterFallback() {
+	if r.state == nil {
+		SetAndFence32(&r.fallback)
+	}
+}
+
+// exitFallback clears the mark set by enterFallback, before the fallback
+// lock is released.
+func (r *RTMContext) exitFallback() {
+	if r.state == nil {
+		r.fallback = 0
+	}
+}
+
+// retry records the aborted attempt'th attempt and reports if the
+// transaction should be attempted again, after backing off.
+// A reader only needs to wait for a fallback writer, but a writer must also
+// wait for fallback readers.
+func (r *RTMContext) retry(status uint32, attempt int, reader bool) bool {
+	r.stats.abort(status)
+	if !r.policy.shouldRetry(status, attempt) {
+		return false
+	}
+	r.policy.backoff(attempt)
+	if r.policy.waitForFallback {
+		for r.fallbackHeld() || (!reader && atomic.LoadInt32(&r.readers) != 0) {
+			Pause()
+		}
+	}
+	return true
+}
+
+// fallbackAtomic runs commiter on the fallback path.
+func (r *RTMContext) fallbackAtomic(commiter func()) {
+	r.stats.fallback()
+	r.lock.Lock()
+	r.enterFallback()
+	commiter()
+	r.exitFallback()
+	r.lock.Unlock()
+}
+
+// fallbackRead runs reader on the fallback path, using the read lock if
+// the fallback lock is an RWLocker.
+func (r *RTMContext) fallbackRead(reader func()) {
+	if r.rlock == nil {
+		r.fallbackAtomic(reader)
+		return
+	}
+	r.stats.fallback()
+	r.rlock.RLock()
+	// Abort any transactional writers, since they could otherwise
+	// commit halfway through this reader
+	atomic.AddInt32(&r.readers, 1)
+	reader()
+	atomic.AddInt32(&r.readers, -1)
+	r.rlock.RUnlock()
+}
+
+// fallbackTry runs commiter on the fallback path, but only if the fallback
+// lock is a TryLocker and it is free. It reports if commiter was executed.
+func (r *RTMContext) fallbackTry(commiter func()) bool {
+	if r.trylock == nil || !r.trylock.TryLock() {
+		return false
+	}
+	r.stats.fallback()
+	r.enterFallback()
+	commiter()
+	r.exitFallback()
+	r.trylock.Unlock()
+	return true
+}
+
+// transact runs commiter as a single RTM transaction attempt, and returns
+// the status of the attempt, which is rtmCommitted if it committed.
+// Writers abort on fallback readers as well as on a fallback writer, but
+// readers only abort on a fallback writer.
+//
 //go:nosplit
-func (r *RTMContext) Atomic(commiter func()) {
-retry:
-	if status := rtm.TxBegin(); status == rtm.TxBeginStarted {
-		// Since the system lock does not have any way to check it's status
-		if r.fallback != 0 {
-			rtm.TxAbort()
+func (r *RTMContext) transact(kind rtmCall, commiter func()) uint32 {
+	status := rtm.TxBegin()
+	if status != rtm.TxBeginStarted {
+		return status
+	}
+	if r.fallbackHeld() || (kind != callRead && r.readers != 0) {
+		// Aborts with lockedAbortCode
+		rtm.TxAbort()
+	}
+	commiter()
+	rtm.TxEnd()
+	return rtmCommitted
+}
+
+// run executes a call of kind as RTM transactions, which are retried
+// according to the retry policy, and takes the fallback path once the
+// policy gives up. It reports if commiter was executed.
+// If tx is not nil, it is updated for the commiter before each attempt.
+func (r *RTMContext) run(kind rtmCall, tx *Tx, commiter func()) bool {
+	for attempt := 1; ; attempt++ {
+		if tx != nil {
+			tx.attempt = attempt - 1
 		}
-		commiter()
-		rtm.TxEnd()
-	} else {
-		if status&(rtm.TxAbortRetry /*|rtm.TxAbortConflict*/) != 0 {
-			// safetyfast.Pause()
-			goto retry
+		status := r.transact(kind, commiter)
+		if status == rtmCommitted {
+			r.stats.commit()
+			return true
 		}
-		// The following lines should be commented out to achieve top performance.
-		if status&rtm.TxAbortCapacity != 0 {
-			atomic.AddUint64(&r.capacityaborts, 1)
+		if !r.retryCall(kind, status, attempt) {
+			return r.fallbackCall(kind, tx, attempt, commiter)
 		}
+	}
+}
 
-		r.lock.Lock()
-		SetAndFence32(&r.fallback)
-		commiter()
-		r.fallback = 0
-		r.lock.Unlock()
+// Atomic executes the commiter in an atomic fasion.
+func (r *RTMContext) Atomic(commiter func()) {
+	r.run(callWrite, nil, commiter)
+}
 
-	}
+// TryAtomic executes the commiter in an atomic fasion, but only if it can
+// be done without waiting. It reports if commiter was executed.
+// At most tryAtomicAttempts transactions are attempted, without any backoff.
+// If they all abort, the fallback lock is only taken if it is a TryLocker
+// and it is free.
+func (r *RTMContext) TryAtomic(commiter func()) bool {
+	return r.run(callTry, nil, commiter)
 }
+
+// AtomicRead executes the reader in an atomic fasion.
+// Transactional readers only abort on a fallback writer, not on readers that
+// fallback. If the fallback lock is an RWLocker, readers that fallback take
+// the read lock, so they can run concurrently.
+func (r *RTMContext) AtomicRead(reader func()) {
+	r.run(callRead, nil, reader)
+}
+
+// AtomicTx executes the commiter in an atomic fasion, while giving it a
+// Tx handle. The commiter can use the handle to check if it is running in a
+// transaction and to explicitly abort the transaction.
+func (r *RTMContext) AtomicTx(commiter func(tx *Tx)) {
+	var tx Tx
+	r.run(callWrite, &tx, func() { commiter(&tx) })
+}
+
+// xabort executes the XABORT instruction with code as the abort code.
+// If not called within a transaction, it returns without any effect.
+func xabort(code uint8)
+
+// xtest executes the XTEST instruction, which reports if the processor is
+// executing a transaction.
+func xtest() bool
@@ -0,0 +1,30 @@
+//go:build !race
+// +build !race
+
+#include "textflag.h"
+
+// XABORT only accepts an immediate code, so a code that is only known at
+// runtime is dispatched through a binary tree over the bits of the code.
+// ABORTk(n) aborts with code n plus the value of the low k bits of AX.
+// The jump of each level skips over the 2^k - 1 instructions of the left
+// subtree.
+#define ABORT0(n) XABORT $(n); RET
+#define ABORT1(n) BTL $0, AX; JCS 3(PC); ABORT0(n); ABORT0(n+1)
+#define ABORT2(n) BTL $1, AX; JCS 7(PC); ABORT1(n); ABORT1(n+2)
+#define ABORT3(n) BTL $2, AX; JCS 15(PC); ABORT2(n); ABORT2(n+4)
+#define ABORT4(n) BTL $3, AX; JCS 31(PC); ABORT3(n); ABORT3(n+8)
+#define ABORT5(n) BTL $4, AX; JCS 63(PC); ABORT4(n); ABORT4(n+16)
+#define ABORT6(n) BTL $5, AX; JCS 127(PC); ABORT5(n); ABORT5(n+32)
+#define ABORT7(n) BTL $6, AX; JCS 255(PC); ABORT6(n); ABORT6(n+64)
+#define ABORT8(n) BTL $7, AX; JCS 511(PC); ABORT7(n); ABORT7(n+128)
+
+// func xabort(code uint8)
+TEXT ·xabort(SB),NOPTR|NOSPLIT,$0-1
+    MOVBLZX code+0(FP), AX
+    ABORT8(0)
+
+// func xtest() bool
+TEXT ·xtest(SB),NOPTR|NOSPLIT,$0-1
+    XTEST
+    SETNE ret+0(FP)
+    RET
@@ -0,0 +1,134 @@
+//go:build !amd64 || race
+// +build !amd64 race
+
+package safetyfast
+
+import "sync"
+
+// RTMContext holds the shared state for the fallback path if the RTM
+// transaction fails.
+// Intel RTM is not available on this architecture, or when built with the
+// race detector, so every call to Atomic takes the fallback path.
+type RTMContext struct {
+	// stats must be first, to be 64 bit aligned on 32 bit architectures
+	stats   rtmStats
+	lock    sync.Locker
+	rlock   RWLocker
+	trylock TryLocker
+	policy  rtmPolicy
+}
+
+// NewRTMContexDefault creates an AtomicContext that tries to use Intel RTM,
+// but can fallback to using the native sync.Mutex.
+// The retry policy can be tuned using opts, but it has no effect on this
+// architecture.
+func NewRTMContexDefault(opts ...RTMOption) *RTMContext {
+	return NewRTMContex(new(sync.Mutex), opts...)
+}
+
+// NewRTMContexRW creates an RWAtomicContext that tries to use Intel RTM,
+// but can fallback to using the native sync.RWMutex.
+// The retry policy can be tuned using opts, but it has no effect on this
+// architecture.
+func NewRTMContexRW(opts ...RTMOption) *RTMContext {
+	return NewRTMContex(new(sync.RWMutex), opts...)
+}
+
+// NewRTMContex creates an AtomicContext that tries to use Intel RTM,
+// but can fallback to using the provided sync.Locker.
+// If l is also an RWLocker, readers use the read lock.
+// The retry policy can be tuned using opts, but it has no effect on this
+// architecture.
+func NewRTMContex(l sync.Locker, opts ...RTMOption) *RTMContext {
+	r := &RTMContext{
+		lock:   l,
+		policy: newRTMPolicy(opts),
+	}
+	r.rlock, _ = l.(RWLocker)
+	r.trylock, _ = l.(TryLocker)
+	return r
+}
+
+// retry records the aborted attempt'th attempt and reports if the
+// transaction should be attempted again, after backing off.
+// No transactions are attempted on this architecture, so only transactions
+// simulated by the tests abort.
+func (r *RTMContext) retry(status uint32, attempt int, reader bool) bool {
+	r.stats.abort(status)
+	if !r.policy.shouldRetry(status, attempt) {
+		return false
+	}
+	r.policy.backoff(attempt)
+	return true
+}
+
+// fallbackAtomic runs commiter on the fallback path.
+func (r *RTMContext) fallbackAtomic(commiter func()) {
+	r.stats.fallback()
+	r.lock.Lock()
+	commiter()
+	r.lock.Unlock()
+}
+
+// fallbackRead runs reader on the fallback path, using the read lock if
+// the fallback lock is an RWLocker.
+func (r *RTMContext) fallbackRead(reader func()) {
+	if r.rlock == nil {
+		r.fallbackAtomic(reader)
+		return
+	}
+	r.stats.fallback()
+	r.rlock.RLock()
+	reader()
+	r.rlock.RUnlock()
+}
+
+// fallbackTry runs commiter on the fallback path, but only if the fallback
+// lock is a TryLocker and it is free. It reports if commiter was executed.
+func (r *RTMContext) fallbackTry(commiter func()) bool {
+	if r.trylock == nil || !r.trylock.TryLock() {
+		return false
+	}
+	r.stats.fallback()
+	commiter()
+	r.trylock.Unlock()
+	return true
+}
+
+// Atomic executes the commiter in an atomic fasion.
+// Since RTM is not available, it always uses the fallback lock.
+func (r *RTMContext) Atomic(commiter func()) {
+	r.fallbackAtomic(commiter)
+}
+
+// TryAtomic executes the commiter in an atomic fasion, but only if it can
+// be done without waiting. It reports if commiter was executed.
+// Since RTM is not available, the commiter is only executed if the fallback
+// lock is a TryLocker and it is free.
+func (r *RTMContext) TryAtomic(commiter func()) bool {
+	return r.fallbackTry(commiter)
+}
+
+// AtomicRead executes the reader in an atomic fasion.
+// Since RTM is not available, it always uses the fallback lock.
+// If the fallback lock is an RWLocker, the read lock is used.
+func (r *RTMContext) AtomicRead(reader func()) {
+	r.fallbackRead(reader)
+}
+
+// AtomicTx executes the commiter in an atomic fasion, while giving it a
+// Tx handle.
+// Since RTM is not available, it always uses the fallback lock, so
+// tx.InTransaction always reports false.
+func (r *RTMContext) AtomicTx(commiter func(tx *Tx)) {
+	tx := Tx{fallback: true}
+	r.fallbackAtomic(func() { commiter(&tx) })
+}
+
+// xabort has no effect, since there are never any transactions to abort.
+func xabort(code uint8) {}
+
+// xtest always reports false, since RTM is not available.
+func xtest() bool {
+	return false
+}
@@ -0,0 +1,47 @@
+package safetyfast
+
+// rtmCall is the kind of call made on an RTMContext.
+type rtmCall int
+
+const (
+	callWrite rtmCall = iota
+	callRead
+	callTry
+)
+
+// rtmCommitted is the status of an attempt that committed. It is the status
+// RTM reports for a started transaction, which can never be confused with
+// an abort status.
+const rtmCommitted = ^uint32(0)
+
+// retryCall records the aborted attempt'th attempt of a call of kind, and
+// reports if the transaction should be attempted again.
+// Calls of kind callTry make at most tryAtomicAttempts attempts, without any
+// backoff.
+func (r *RTMContext) retryCall(kind rtmCall, status uint32, attempt int) bool {
+	if kind != callTry {
+		return r.retry(status, attempt, kind == callRead)
+	}
+	r.stats.abort(status)
+	return attempt < tryAtomicAttempts && r.policy.shouldRetry(status, attempt)
+}
+
+// fallbackCall runs the commiter of a call of kind on the fallback path,
+// after attempt attempts aborted, and reports if commiter was executed.
+// Calls of kind callTry only take the fallback lock if it is a TryLocker and
+// it is free. If tx is not nil, it is updated for the fallback path.
+func (r *RTMContext) fallbackCall(kind rtmCall, tx *Tx, attempt int, commiter func()) bool {
+	if tx != nil {
+		tx.attempt = attempt
+		tx.fallback = true
+	}
+	switch kind {
+	case callRead:
+		r.fallbackRead(commiter)
+	case callTry:
+		return r.fallbackTry(commiter)
+	default:
+		r.fallbackAtomic(commiter)
+	}
+	return true
+}
@@ -0,0 +1,322 @@
+package safetyfast
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// faultCommit is the status a faultInjector returns for an attempt that
+// should commit.
+const faultCommit = rtmCommitted
+
+// faultInjector scripts the outcome of the transactions attempted by a
+// faultContext.
+// It is called with the number of the call made on the context, starting
+// from 0, and the number of the attempt within that call, starting from 1.
+// It returns the abort status the attempt reports, like AbortCapacity, or
+// faultCommit if the attempt commits.
+// It may be called concurrently.
+type faultInjector func(call, attempt int) uint32
+
+// faultSequence returns a faultInjector that aborts the attempts of every
+// call with statuses, in order, and then commits.
+// For example, faultSequence(AbortCapacity, AbortCapacity, AbortConflict)
+// aborts with capacity on attempts 1 and 2, with conflict on attempt 3, and
+// commits on attempt 4, unless the retry policy gives up before then.
+func faultSequence(statuses ...uint32) faultInjector {
+	return func(call, attempt int) uint32 {
+		if attempt > len(statuses) {
+			return faultCommit
+		}
+		return statuses[attempt-1]
+	}
+}
+
+// faultAlways returns a faultInjector that aborts every attempt with status,
+// so every call that the retry policy gives up on takes the fallback path.
+func faultAlways(status uint32) faultInjector {
+	return func(call, attempt int) uint32 {
+		return status
+	}
+}
+
+// faultContext is an RTMContext whose transactions are scripted by a
+// faultInjector, instead of being run by the processor, so that the
+// fallback behavior of commiters can be tested on any architecture.
+// It applies the retry policy, records statistics, and takes the fallback
+// path using the same code as an RTMContext.
+// An attempt that commits is simulated by running the commiter while holding
+// the lock, and tx.InTransaction reports true within it. Calling tx.Abort
+// within a simulated transaction unwinds the commiter, but does not undo its
+// writes.
+type faultContext struct {
+	*RTMContext
+	inject faultInjector
+	// calls counts the calls made on the context
+	calls uint32
+}
+
+func newRTMContextFaults(l sync.Locker, inject faultInjector, opts ...RTMOption) *faultContext {
+	return &faultContext{
+		RTMContext: NewRTMContex(l, opts...),
+		inject:     inject,
+	}
+}
+
+// run executes a call of kind like RTMContext.run, but with its attempts
+// simulated.
+func (f *faultContext) run(kind rtmCall, tx *Tx, commiter func()) bool {
+	call := int(atomic.AddUint32(&f.calls, 1) - 1)
+	for attempt := 1; ; attempt++ {
+		if tx != nil {
+			tx.attempt = attempt - 1
+		}
+		status := f.simulate(kind, call, attempt, tx, commiter)
+		if status == rtmCommitted {
+			f.stats.commit()
+			return true
+		}
+		if !f.retryCall(kind, status, attempt) {
+			return f.fallbackCall(kind, tx, attempt, commiter)
+		}
+	}
+}
+
+// simulate runs the attempt'th transaction attempt of the call'th call as
+// scripted by f.inject, and returns the status of the attempt, which is
+// rtmCommitted if it committed.
+// An attempt of TryAtomic does not wait for the lock, but aborts like a
+// transaction that finds the fallback path in use, if the lock is not free
+// or is not a TryLocker.
+func (f *faultContext) simulate(kind rtmCall, call, attempt int, tx *Tx, commiter func()) (status uint32) {
+	if status = f.inject(call, attempt); status != faultCommit {
+		return status
+	}
+	switch {
+	case kind == callTry:
+		if f.trylock == nil || !f.trylock.TryLock() {
+			return AbortExplicit | lockedAbortCode<<24
+		}
+		defer f.trylock.Unlock()
+	case kind == callRead && f.rlock != nil:
+		f.rlock.RLock()
+		defer f.rlock.RUnlock()
+	default:
+		f.lock.Lock()
+		defer f.lock.Unlock()
+	}
+	if tx != nil {
+		tx.simulated = true
+	}
+	defer func() {
+		if tx != nil {
+			tx.simulated = false
+		}
+		if v := recover(); v != nil {
+			a, ok := v.(softAbort)
+			if !ok {
+				panic(v)
+			}
+			status = uint32(a)
+		}
+	}()
+	commiter()
+	return rtmCommitted
+}
+
+func (f *faultContext) Atomic(commiter func()) {
+	f.run(callWrite, nil, commiter)
+}
+
+func (f *faultContext) TryAtomic(commiter func()) bool {
+	return f.run(callTry, nil, commiter)
+}
+
+func (f *faultContext) AtomicRead(reader func()) {
+	f.run(callRead, nil, reader)
+}
+
+func (f *faultContext) AtomicTx(commiter func(tx *Tx)) {
+	var tx Tx
+	f.run(callWrite, &tx, func() { commiter(&tx) })
+}
+
+func (f *faultContext) AtomicErr(commiter func() error) error {
+	return DoErr(f, commiter)
+}
+
+func TestRTMContextFaults(t *testing.T) {
+	t.Run("Sequence", func(t *testing.T) {
+		c := newRTMContextFaults(new(sync.Mutex),
+			faultSequence(AbortCapacity, AbortCapacity, AbortCapacity, AbortConflict),
+			WithRetryOn(AbortCapacity|AbortConflict))
+		var attempt int
+		var inTx bool
+		c.AtomicTx(func(tx *Tx) {
+			attempt = tx.Attempt()
+			inTx = tx.InTransaction()
+		})
+		if attempt != 4 || !inTx {
+			t.Errorf("Commiter ran with Attempt=%d InTransaction=%v, but we expected 4 and true", attempt, inTx)
+		}
+		stats := c.Stats()
+		if stats.Capacity != 3 || stats.Conflict != 1 || stats.Commits != 1 || stats.Fallbacks != 0 {
+			t.Errorf("Capacity=%d Conflict=%d Commits=%d Fallbacks=%d, but we expected 3, 1, 1 and 0",
+				stats.Capacity, stats.Conflict, stats.Commits, stats.Fallbacks)
+		}
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		c := newRTMContextFaults(new(sync.Mutex), faultSequence(AbortCapacity))
+		var attempt int
+		var inTx bool
+		c.AtomicTx(func(tx *Tx) {
+			attempt = tx.Attempt()
+			inTx = tx.InTransaction()
+		})
+		if attempt != 1 || inTx {
+			t.Errorf("Commiter ran with Attempt=%d InTransaction=%v, but we expected 1 and false", attempt, inTx)
+		}
+		stats := c.Stats()
+		if stats.Capacity != 1 || stats.Commits != 0 || stats.Fallbacks != 1 {
+			t.Errorf("Capacity=%d Commits=%d Fallbacks=%d, but we expected 1, 0 and 1",
+				stats.Capacity, stats.Commits, stats.Fallbacks)
+		}
+	})
+
+	t.Run("Always", func(t *testing.T) {
+		c := newRTMContextFaults(new(sync.Mutex), faultAlways(AbortRetry), WithMaxAttempts(5))
+		var count int
+		c.Atomic(func() {
+			count++
+		})
+		if count != 1 {
+			t.Errorf("Commiter ran %d times instead of once", count)
+		}
+		stats := c.Stats()
+		if stats.Aborts != 5 || stats.Retry != 5 || stats.Fallbacks != 1 {
+			t.Errorf("Aborts=%d Retry=%d Fallbacks=%d, but we expected 5, 5 and 1",
+				stats.Aborts, stats.Retry, stats.Fallbacks)
+		}
+	})
+
+	t.Run("PerCall", func(t *testing.T) {
+		c := newRTMContextFaults(new(sync.Mutex), func(call, attempt int) uint32 {
+			if call%2 == 0 {
+				return faultCommit
+			}
+			return AbortConflict
+		})
+		for i := 0; i < 10; i++ {
+			c.Atomic(func() {})
+		}
+		stats := c.Stats()
+		if stats.Commits != 5 || stats.Fallbacks != 5 {
+			t.Errorf("Commits=%d Fallbacks=%d, but we expected 5 and 5", stats.Commits, stats.Fallbacks)
+		}
+	})
+
+	t.Run("Explicit", func(t *testing.T) {
+		c := newRTMContextFaults(new(sync.Mutex), faultSequence())
+		var attempts []int
+		c.AtomicTx(func(tx *Tx) {
+			attempts = append(attempts, tx.Attempt())
+			tx.Abort(3)
+		})
+		if len(attempts) != 2 || attempts[0] != 0 || attempts[1] != 1 {
+			t.Errorf("Commiter ran on attempts %v instead of [0 1]", attempts)
+		}
+		stats := c.Stats()
+		if stats.Explicit != 1 || stats.ExplicitCodes[3] != 1 || stats.Fallbacks != 1 {
+			t.Errorf("Explicit=%d ExplicitCodes[3]=%d Fallbacks=%d, but we expected 1, 1 and 1",
+				stats.Explicit, stats.ExplicitCodes[3], stats.Fallbacks)
+		}
+	})
+
+	t.Run("TryAtomic", func(t *testing.T) {
+		var m sync.Mutex
+		c := newRTMContextFaults(&m, faultAlways(AbortRetry))
+		if !c.TryAtomic(func() {}) {
+			t.Error("TryAtomic did not execute the commiter on a free lock")
+		}
+		m.Lock()
+		if c.TryAtomic(func() {}) {
+			t.Error("TryAtomic executed the commiter on a held lock")
+		}
+		m.Unlock()
+		stats := c.Stats()
+		if stats.Aborts != 2*tryAtomicAttempts || stats.Fallbacks != 1 {
+			t.Errorf("Aborts=%d Fallbacks=%d, but we expected %d and 1",
+				stats.Aborts, stats.Fallbacks, 2*tryAtomicAttempts)
+		}
+	})
+
+	t.Run("TryAtomicCommit", func(t *testing.T) {
+		var m sync.Mutex
+		c := newRTMContextFaults(&m, faultSequence())
+		// A simulated transaction must not wait for the lock either
+		m.Lock()
+		if c.TryAtomic(func() {}) {
+			t.Error("TryAtomic executed the commiter on a held lock")
+		}
+		m.Unlock()
+		if !c.TryAtomic(func() {}) {
+			t.Error("TryAtomic did not execute the commiter on a free lock")
+		}
+		stats := c.Stats()
+		if stats.Explicit != 1 || stats.ExplicitCodes[lockedAbortCode] != 1 || stats.Commits != 1 || stats.Fallbacks != 0 {
+			t.Errorf("Explicit=%d ExplicitCodes[lockedAbortCode]=%d Commits=%d Fallbacks=%d, but we expected 1, 1, 1 and 0",
+				stats.Explicit, stats.ExplicitCodes[lockedAbortCode], stats.Commits, stats.Fallbacks)
+		}
+	})
+
+	t.Run("AtomicRead", func(t *testing.T) {
+		var m sync.RWMutex
+		c := newRTMContextFaults(&m, faultSequence(AbortConflict))
+		// Readers that fallback must only take the read lock
+		m.RLock()
+		c.AtomicRead(func() {})
+		m.RUnlock()
+		stats := c.Stats()
+		if stats.Conflict != 1 || stats.Fallbacks != 1 {
+			t.Errorf("Conflict=%d Fallbacks=%d, but we expected 1 and 1", stats.Conflict, stats.Fallbacks)
+		}
+	})
+}
+
+func TestRTMContextFaultsConcurrent(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const numIterations = 10000
+
+	c := newRTMContextFaults(new(sync.Mutex), func(call, attempt int) uint32 {
+		if call%3 == 0 {
+			return AbortCapacity
+		}
+		return faultCommit
+	})
+
+	var wg sync.WaitGroup
+	var count int
+	wg.Add(numConcurGoRoutines)
+	for i := 0; i < numConcurGoRoutines; i++ {
+		go func() {
+			for i := 0; i < numIterations; i++ {
+				c.Atomic(func() {
+					count++
+				})
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if expected := numConcurGoRoutines * numIterations; count != expected {
+		t.Fatalf("Count is %d, but we expected %d", count, expected)
+	}
+	stats := c.Stats()
+	if stats.Commits+stats.Fallbacks != uint64(count) || stats.Fallbacks != stats.Capacity {
+		t.Errorf("Commits=%d Fallbacks=%d Capacity=%d do not add up to %d calls",
+			stats.Commits, stats.Fallbacks, stats.Capacity, count)
+	}
+}
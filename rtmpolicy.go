@@ -0,0 +1,140 @@
+package safetyfast
+
+import "math/rand"
+
+// RTMOption configures the retry policy of an RTMContext.
+type RTMOption func(p *rtmPolicy)
+
+// rtmPolicy decides what an RTMContext does after a transaction aborts.
+type rtmPolicy struct {
+	// maxAttempts is the maximum number of transactional attempts before
+	// taking the fallback path. A value of 0 means no limit.
+	maxAttempts int
+	// retryOn holds the abort status bits that cause a retry.
+	retryOn uint32
+	// backoffMin and backoffMax bound the number of Pause instructions
+	// executed between attempts. A backoffMax of 0 disables backoff.
+	backoffMin, backoffMax int
+	// backoffRandom selects a uniformly random number of pauses, up to the
+	// exponential bound.
+	backoffRandom bool
+	// waitForFallback causes a retry to wait until the fallback lock is free.
+	waitForFallback bool
+	// softCapacity is the number of words a SoftRTMContext transaction may
+	// read and write.
+	softCapacity int
+}
+
+// tryAtomicAttempts is the maximum number of transactions TryAtomic
+// attempts before considering the fallback lock.
+const tryAtomicAttempts = 3
+
+// defaultRTMPolicy retries forever on AbortRetry, never retries any other
+// abort cause, and never backs off.
+var defaultRTMPolicy = rtmPolicy{
+	retryOn:      AbortRetry,
+	softCapacity: DefaultSoftCapacity,
+}
+
+func newRTMPolicy(opts []RTMOption) rtmPolicy {
+	p := defaultRTMPolicy
+	for _, opt := range opts {
+		opt(&p)
+	}
+	return p
+}
+
+// WithMaxAttempts limits the number of transactional attempts made by each
+// call to Atomic, before the fallback lock is taken.
+// A value of 0, the default, means the number of attempts is unlimited.
+func WithMaxAttempts(attempts int) RTMOption {
+	return func(p *rtmPolicy) {
+		p.maxAttempts = attempts
+	}
+}
+
+// WithRetryOn sets which abort causes trigger another transactional attempt,
+// instead of taking the fallback lock.
+// The causes are a combination of AbortRetry, AbortConflict, AbortCapacity,
+// and the other Abort status bits. The default is AbortRetry.
+func WithRetryOn(causes uint32) RTMOption {
+	return func(p *rtmPolicy) {
+		p.retryOn = causes
+	}
+}
+
+// WithExponentialBackoff makes a retry wait for min Pause instructions after
+// the first abort, doubling for each subsequent abort, up to max.
+func WithExponentialBackoff(min, max int) RTMOption {
+	return func(p *rtmPolicy) {
+		p.backoffMin = min
+		p.backoffMax = max
+		p.backoffRandom = false
+	}
+}
+
+// WithRandomBackoff makes a retry wait for a random number of Pause
+// instructions, chosen between 0 and an exponential bound that starts at min
+// and doubles for each subsequent abort, up to max.
+func WithRandomBackoff(min, max int) RTMOption {
+	return func(p *rtmPolicy) {
+		p.backoffMin = min
+		p.backoffMax = max
+		p.backoffRandom = true
+	}
+}
+
+// WithWaitForFallback makes a retry wait until the fallback lock is free.
+// A transaction that finds the fallback lock held is also retried, instead of
+// taking the fallback lock itself.
+// This avoids the lemming effect, where one fallback causes all concurrent
+// transactions to abort and fallback too, serializing the context.
+func WithWaitForFallback() RTMOption {
+	return func(p *rtmPolicy) {
+		p.waitForFallback = true
+	}
+}
+
+// shouldRetry reports if another transactional attempt should be made after
+// the attempt'th attempt aborted with status.
+func (p *rtmPolicy) shouldRetry(status uint32, attempt int) bool {
+	if p.maxAttempts > 0 && attempt >= p.maxAttempts {
+		return false
+	}
+	if status&p.retryOn != 0 {
+		return true
+	}
+	if p.waitForFallback && status&AbortExplicit != 0 && AbortCode(status) == lockedAbortCode {
+		return true
+	}
+	return false
+}
+
+// backoffPauses returns the number of Pause instructions to execute after
+// the attempt'th attempt aborted.
+func (p *rtmPolicy) backoffPauses(attempt int) int {
+	if p.backoffMax <= 0 {
+		return 0
+	}
+	n := p.backoffMin
+	if n < 1 {
+		n = 1
+	}
+	for i := 1; i < attempt && n < p.backoffMax; i++ {
+		n <<= 1
+	}
+	if n > p.backoffMax || n <= 0 {
+		n = p.backoffMax
+	}
+	if p.backoffRandom {
+		n = rand.Intn(n + 1)
+	}
+	return n
+}
+
+// backoff executes the Pause instruction backoffPauses times.
+func (p *rtmPolicy) backoff(attempt int) {
+	for n := p.backoffPauses(attempt); n > 0; n-- {
+		Pause()
+	}
+}
@@ -0,0 +1,67 @@
+package safetyfast
+
+import "testing"
+
+func TestRTMPolicyShouldRetry(t *testing.T) {
+	lockedAbort := AbortExplicit | uint32(lockedAbortCode)<<24
+
+	tests := []struct {
+		name    string
+		opts    []RTMOption
+		status  uint32
+		attempt int
+		retry   bool
+	}{
+		{"Default Retry", nil, AbortRetry, 1000, true},
+		{"Default Conflict", nil, AbortConflict, 1, false},
+		{"Default Capacity", nil, AbortCapacity, 1, false},
+		{"Default Locked", nil, lockedAbort, 1, false},
+		{"RetryOn Conflict", []RTMOption{WithRetryOn(AbortConflict)}, AbortConflict, 1, true},
+		{"RetryOn Conflict Retry", []RTMOption{WithRetryOn(AbortConflict)}, AbortRetry, 1, false},
+		{"MaxAttempts Below", []RTMOption{WithMaxAttempts(3)}, AbortRetry, 2, true},
+		{"MaxAttempts Reached", []RTMOption{WithMaxAttempts(3)}, AbortRetry, 3, false},
+		{"WaitForFallback Locked", []RTMOption{WithWaitForFallback()}, lockedAbort, 1, true},
+		{"WaitForFallback Explicit", []RTMOption{WithWaitForFallback()}, AbortExplicit | 1<<24, 1, false},
+		{"WaitForFallback MaxAttempts", []RTMOption{WithWaitForFallback(), WithMaxAttempts(2)}, lockedAbort, 2, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newRTMPolicy(test.opts)
+			if retry := p.shouldRetry(test.status, test.attempt); retry != test.retry {
+				t.Errorf("shouldRetry(%#x, %d) returned %v instead of %v", test.status, test.attempt, retry, test.retry)
+			}
+		})
+	}
+}
+
+func TestRTMPolicyBackoff(t *testing.T) {
+	t.Run("None", func(t *testing.T) {
+		p := newRTMPolicy(nil)
+		for attempt := 1; attempt < 10; attempt++ {
+			if n := p.backoffPauses(attempt); n != 0 {
+				t.Errorf("backoffPauses(%d) returned %d instead of 0", attempt, n)
+			}
+		}
+	})
+	t.Run("Exponential", func(t *testing.T) {
+		p := newRTMPolicy([]RTMOption{WithExponentialBackoff(4, 40)})
+		expected := []int{4, 8, 16, 32, 40, 40}
+		for i, e := range expected {
+			if n := p.backoffPauses(i + 1); n != e {
+				t.Errorf("backoffPauses(%d) returned %d instead of %d", i+1, n, e)
+			}
+		}
+	})
+	t.Run("Random", func(t *testing.T) {
+		p := newRTMPolicy([]RTMOption{WithRandomBackoff(4, 40)})
+		bounds := []int{4, 8, 16, 32, 40, 40}
+		for i, b := range bounds {
+			for j := 0; j < 100; j++ {
+				if n := p.backoffPauses(i + 1); n < 0 || n > b {
+					t.Fatalf("backoffPauses(%d) returned %d, which is not within [0, %d]", i+1, n, b)
+				}
+			}
+		}
+	})
+}
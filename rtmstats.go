@@ -0,0 +1,175 @@
+package safetyfast
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// RTMStats is a snapshot of the transaction statistics of an RTMContext.
+// An abort can be attributed to multiple causes, so the sum of the
+// per cause counters may be larger than Aborts.
+type RTMStats struct {
+	// Commits is the number of transactions that committed.
+	Commits uint64
+	// Attempts is the number of transactions that were started.
+	Attempts uint64
+	// Aborts is the number of transactions that aborted.
+	Aborts uint64
+	// Fallbacks is the number of commiters run on the fallback path.
+	Fallbacks uint64
+
+	// Explicit is the number of aborts caused by XABORT.
+	Explicit uint64
+	// Retry is the number of aborts that indicated a retry may succeed.
+	Retry uint64
+	// Conflict is the number of aborts caused by a memory conflict.
+	Conflict uint64
+	// Capacity is the number of aborts caused by cache capacity.
+	Capacity uint64
+	// Debug is the number of aborts caused by a debug breakpoint.
+	Debug uint64
+	// Nested is the number of aborts that occurred in a nested transaction.
+	Nested uint64
+	// Unknown is the number of aborts that did not indicate any cause.
+	// These are typically caused by interrupts, page faults, or
+	// unsupported instructions.
+	Unknown uint64
+
+	// ExplicitCodes holds the number of explicit aborts for each XABORT code.
+	ExplicitCodes [256]uint64
+}
+
+const (
+	statCommits = iota
+	statAborts
+	statFallbacks
+	statExplicit
+	statRetry
+	statConflict
+	statCapacity
+	statDebug
+	statNested
+	statUnknown
+	numStats
+)
+
+// rtmStatsShards is the number of shards the counters are striped across,
+// in order to keep concurrent goroutines from contending on the same cache
+// line. It must be a power of 2.
+const rtmStatsShards = 16
+
+// rtmStatsShard holds one stripe of counters, padded to its own cache lines.
+type rtmStatsShard struct {
+	counters [numStats]uint64
+	_        [128 - numStats*8%128]byte
+}
+
+// rtmStats holds the live counters of an RTMContext.
+type rtmStats struct {
+	shards        [rtmStatsShards]rtmStatsShard
+	explicitCodes [256]uint64
+}
+
+// shard returns the counter stripe for the calling goroutine.
+// The stripe is chosen using the goroutine's stack address, which differs
+// between goroutines, but is cheap to find.
+func (s *rtmStats) shard() *rtmStatsShard {
+	var marker byte
+	p := uintptr(unsafe.Pointer(&marker))
+	return &s.shards[((p>>10)^(p>>16))&(rtmStatsShards-1)]
+}
+
+func (s *rtmStats) commit() {
+	atomic.AddUint64(&s.shard().counters[statCommits], 1)
+}
+
+func (s *rtmStats) fallback() {
+	atomic.AddUint64(&s.shard().counters[statFallbacks], 1)
+}
+
+// abort counts an aborted transaction under each cause set in status.
+func (s *rtmStats) abort(status uint32) {
+	c := &s.shard().counters
+	atomic.AddUint64(&c[statAborts], 1)
+	if status&(AbortExplicit|AbortRetry|AbortConflict|AbortCapacity|AbortDebug|AbortNested) == 0 {
+		atomic.AddUint64(&c[statUnknown], 1)
+		return
+	}
+	if status&AbortExplicit != 0 {
+		atomic.AddUint64(&c[statExplicit], 1)
+		atomic.AddUint64(&s.explicitCodes[AbortCode(status)], 1)
+	}
+	if status&AbortRetry != 0 {
+		atomic.AddUint64(&c[statRetry], 1)
+	}
+	if status&AbortConflict != 0 {
+		atomic.AddUint64(&c[statConflict], 1)
+	}
+	if status&AbortCapacity != 0 {
+		atomic.AddUint64(&c[statCapacity], 1)
+	}
+	if status&AbortDebug != 0 {
+		atomic.AddUint64(&c[statDebug], 1)
+	}
+	if status&AbortNested != 0 {
+		atomic.AddUint64(&c[statNested], 1)
+	}
+}
+
+func (s *rtmStats) snapshot() RTMStats {
+	var counters [numStats]uint64
+	for i := range s.shards {
+		for j := range counters {
+			counters[j] += atomic.LoadUint64(&s.shards[i].counters[j])
+		}
+	}
+
+	st := RTMStats{
+		Commits:   counters[statCommits],
+		Attempts:  counters[statCommits] + counters[statAborts],
+		Aborts:    counters[statAborts],
+		Fallbacks: counters[statFallbacks],
+		Explicit:  counters[statExplicit],
+		Retry:     counters[statRetry],
+		Conflict:  counters[statConflict],
+		Capacity:  counters[statCapacity],
+		Debug:     counters[statDebug],
+		Nested:    counters[statNested],
+		Unknown:   counters[statUnknown],
+	}
+	for i := range s.explicitCodes {
+		st.ExplicitCodes[i] = atomic.LoadUint64(&s.explicitCodes[i])
+	}
+	return st
+}
+
+func (s *rtmStats) reset() {
+	for i := range s.shards {
+		for j := range s.shards[i].counters {
+			atomic.StoreUint64(&s.shards[i].counters[j], 0)
+		}
+	}
+	for i := range s.explicitCodes {
+		atomic.StoreUint64(&s.explicitCodes[i], 0)
+	}
+}
+
+// Stats returns a snapshot of the transaction statistics of this context.
+// The counters are read individually, so the snapshot is not guaranteed to
+// be consistent while other goroutines are using the context.
+func (r *RTMContext) Stats() RTMStats {
+	return r.stats.snapshot()
+}
+
+// Reset sets all transaction statistics of this context to zero.
+func (r *RTMContext) Reset() {
+	r.stats.reset()
+}
+
+// CapacityAborts returns the number of aborts that were due to cache capacity.
+// If you see lots of capacity aborts, this means the commiter function
+// if touching too many memory locations and is unlikely to be reaping any gains
+// from using an RTMContext.
+func (r *RTMContext) CapacityAborts() uint64 {
+	return r.Stats().Capacity
+}
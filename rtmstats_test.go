@@ -0,0 +1,73 @@
+package safetyfast
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRTMStats(t *testing.T) {
+	var s rtmStats
+
+	s.commit()
+	s.commit()
+	s.fallback()
+	s.abort(AbortRetry | AbortConflict)
+	s.abort(AbortCapacity)
+	s.abort(AbortExplicit | uint32(lockedAbortCode)<<24)
+	s.abort(AbortExplicit | 7<<24)
+	s.abort(AbortDebug | AbortNested)
+	s.abort(0)
+
+	st := s.snapshot()
+	expected := RTMStats{
+		Commits:   2,
+		Attempts:  8,
+		Aborts:    6,
+		Fallbacks: 1,
+		Explicit:  2,
+		Retry:     1,
+		Conflict:  1,
+		Capacity:  1,
+		Debug:     1,
+		Nested:    1,
+		Unknown:   1,
+	}
+	expected.ExplicitCodes[lockedAbortCode] = 1
+	expected.ExplicitCodes[7] = 1
+	if st != expected {
+		t.Errorf("Stats are %+v, but we expected %+v", st, expected)
+	}
+
+	s.reset()
+	if st := s.snapshot(); st != (RTMStats{}) {
+		t.Errorf("Stats are %+v after reset, but we expected all zeros", st)
+	}
+}
+
+func TestRTMStatsConcurrent(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const numIterations = 100000 / raceScale
+
+	var s rtmStats
+	var wg sync.WaitGroup
+
+	wg.Add(numConcurGoRoutines)
+	for i := 0; i < numConcurGoRoutines; i++ {
+		go func() {
+			for i := 0; i < numIterations; i++ {
+				s.commit()
+				s.abort(AbortConflict)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	st := s.snapshot()
+	if st.Commits != numConcurGoRoutines*numIterations {
+		t.Errorf("Commits is %d, but we expected %d", st.Commits, numConcurGoRoutines*numIterations)
+	}
+	if st.Conflict != numConcurGoRoutines*numIterations {
+		t.Errorf("Conflict is %d, but we expected %d", st.Conflict, numConcurGoRoutines*numIterations)
+	}
+}
@@ -0,0 +1,234 @@
+package safetyfast
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpinRWMutex is a sync.RWMutex replacement built on SpinMutex.
+// Any number of readers can hold the lock at once, or a single writer.
+// It prefers writers: once a writer is waiting, new readers wait until the
+// writer released the lock, so a steady stream of readers can not starve
+// writers.
+// The zero value is an unlocked mutex.
+type SpinRWMutex struct {
+	// writer is held by the writer, including while it waits for readers
+	// to leave, which keeps new readers out
+	writer SpinMutex
+	// readers is the number of readers holding the lock
+	readers int32
+}
+
+// spinWhile spins until cond reports false, and invokes the scheduler
+// every LockAttempts spins.
+func spinWhile(cond func() bool) {
+	attempts := LockAttempts
+	for cond() {
+		Pause()
+		if attempts--; attempts == 0 {
+			attempts = LockAttempts
+			// Invoke scheduler to allow other to run
+			runtime.Gosched()
+		}
+	}
+}
+
+// RLock acquires the lock for reading.
+func (m *SpinRWMutex) RLock() {
+	for !m.TryRLock() {
+		spinWhile(m.writer.IsLocked)
+	}
+}
+
+// TryRLock tries to acquire the lock for reading once, without waiting,
+// and reports if it succeeded. It fails while a writer holds or waits for
+// the lock.
+func (m *SpinRWMutex) TryRLock() bool {
+	if m.writer.IsLocked() {
+		return false
+	}
+	// Announce the reader before checking for a writer again, so that
+	// either the writer sees the reader or the reader sees the writer
+	atomic.AddInt32(&m.readers, 1)
+	if !m.writer.IsLocked() {
+		return true
+	}
+	atomic.AddInt32(&m.readers, -1)
+	return false
+}
+
+// RUnlock releases the lock for reading.
+func (m *SpinRWMutex) RUnlock() {
+	atomic.AddInt32(&m.readers, -1)
+}
+
+// readersActive reports if any reader holds the lock.
+func (m *SpinRWMutex) readersActive() bool {
+	return atomic.LoadInt32(&m.readers) != 0
+}
+
+// Lock acquires the lock for writing. New readers are kept out while Lock
+// waits for the readers holding the lock to release it.
+func (m *SpinRWMutex) Lock() {
+	m.writer.Lock()
+	spinWhile(m.readersActive)
+}
+
+// TryLock tries to acquire the lock for writing once, without waiting, and
+// reports if it succeeded.
+func (m *SpinRWMutex) TryLock() bool {
+	if !m.writer.TryLock() {
+		return false
+	}
+	if m.readersActive() {
+		m.writer.Unlock()
+		return false
+	}
+	return true
+}
+
+// lockWithin acquires the lock for writing using acquire, which runs the
+// given spin round until it succeeds or the caller gives up, and reports
+// if the lock was acquired. Once the writer's lock is taken, it is kept
+// while waiting for readers, so that new readers stay out, and released if
+// the caller gives up.
+func (m *SpinRWMutex) lockWithin(acquire func(spinRound func() bool) bool) bool {
+	var held bool
+	if acquire(func() bool {
+		if !held {
+			if !m.writer.spinRound() {
+				return false
+			}
+			held = true
+		}
+		for attempts := LockAttempts; m.readersActive(); attempts-- {
+			if attempts == 0 {
+				return false
+			}
+			Pause()
+		}
+		return true
+	}) {
+		return true
+	}
+	if held {
+		m.writer.Unlock()
+	}
+	return false
+}
+
+// LockTimeout acquires the lock for writing, unless it could not be
+// acquired within d. It reports if the lock was acquired.
+// New readers are kept out while LockTimeout waits for the readers holding
+// the lock, until it gives up.
+func (m *SpinRWMutex) LockTimeout(d time.Duration) bool {
+	return m.lockWithin(func(spinRound func() bool) bool {
+		return lockTimeout(spinRound, d)
+	})
+}
+
+// LockContext acquires the lock for writing, unless ctx is done first, in
+// which case it returns the context's error.
+// New readers are kept out while LockContext waits for the readers holding
+// the lock, until it gives up.
+func (m *SpinRWMutex) LockContext(ctx context.Context) error {
+	var err error
+	m.lockWithin(func(spinRound func() bool) bool {
+		err = lockContext(spinRound, ctx)
+		return err == nil
+	})
+	return err
+}
+
+// Unlock releases the lock for writing.
+func (m *SpinRWMutex) Unlock() {
+	m.writer.Unlock()
+}
+
+// IsLocked reports if a writer holds or waits for the lock.
+// Readers are not reported, which allows an RTMContext using the mutex as
+// its fallback lock to run transactional readers alongside readers that
+// fell back.
+func (m *SpinRWMutex) IsLocked() bool {
+	return m.writer.IsLocked()
+}
+
+// RLocker returns a sync.Locker that locks and unlocks m for reading.
+func (m *SpinRWMutex) RLocker() sync.Locker {
+	return (*spinRLocker)(m)
+}
+
+type spinRLocker SpinRWMutex
+
+func (r *spinRLocker) Lock()   { (*SpinRWMutex)(r).RLock() }
+func (r *spinRLocker) Unlock() { (*SpinRWMutex)(r).RUnlock() }
+
+// ElidedRWMutex is a SpinRWMutex whose readers are elided using Intel RTM.
+//
+// RLock starts a transaction that only reads the writer's lock, and RUnlock
+// commits it, so readers never write to the mutex and do not bounce its
+// cache line between cores, unlike the reader count of sync.RWMutex.
+// A writer acquires the lock for real, which aborts all elided readers.
+// Readers are only counted after their transaction aborts too many times.
+// Read sections must not make system calls or otherwise cause aborts that
+// can never succeed, and a read section must not start or end within
+// another transaction.
+//
+// When RTM is not available, it behaves like a SpinRWMutex.
+// The zero value is an unlocked mutex.
+type ElidedRWMutex struct {
+	rw SpinRWMutex
+}
+
+// TryRLock tries to acquire the lock for reading once, without waiting,
+// and reports if it succeeded. The lock is acquired for real, rather than
+// elided.
+func (m *ElidedRWMutex) TryRLock() bool {
+	return m.rw.TryRLock()
+}
+
+// Lock acquires the lock for writing. Writers are never elided.
+func (m *ElidedRWMutex) Lock() {
+	m.rw.Lock()
+}
+
+// TryLock tries to acquire the lock for writing once, without waiting, and
+// reports if it succeeded.
+func (m *ElidedRWMutex) TryLock() bool {
+	return m.rw.TryLock()
+}
+
+// LockTimeout acquires the lock for writing, unless it could not be
+// acquired within d. It reports if the lock was acquired.
+func (m *ElidedRWMutex) LockTimeout(d time.Duration) bool {
+	return m.rw.LockTimeout(d)
+}
+
+// LockContext acquires the lock for writing, unless ctx is done first, in
+// which case it returns the context's error.
+func (m *ElidedRWMutex) LockContext(ctx context.Context) error {
+	return m.rw.LockContext(ctx)
+}
+
+// Unlock releases the lock for writing.
+func (m *ElidedRWMutex) Unlock() {
+	m.rw.Unlock()
+}
+
+// IsLocked reports if a writer holds or waits for the lock.
+func (m *ElidedRWMutex) IsLocked() bool {
+	return m.rw.IsLocked()
+}
+
+// RLocker returns a sync.Locker that locks and unlocks m for reading.
+func (m *ElidedRWMutex) RLocker() sync.Locker {
+	return (*elidedRLocker)(m)
+}
+
+type elidedRLocker ElidedRWMutex
+
+func (r *elidedRLocker) Lock()   { (*ElidedRWMutex)(r).RLock() }
+func (r *elidedRLocker) Unlock() { (*ElidedRWMutex)(r).RUnlock() }
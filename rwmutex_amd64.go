@@ -0,0 +1,49 @@
+//go:build !race
+// +build !race
+
+package safetyfast
+
+import rtm "github.com/0xmjk/go-tsx-rtm"
+
+// RLock starts an elided read section, or acquires the lock for reading if
+// the section can not be elided.
+// When elided, RLock returns within a transaction that is committed by
+// RUnlock. If the transaction aborts, execution resumes within RLock, which
+// retries or acquires the lock.
+//
+//go:nosplit
+func (m *ElidedRWMutex) RLock() {
+	if !RTMAvailable() {
+		m.rw.RLock()
+		return
+	}
+	var attempt int
+retry:
+	attempt++
+	if status := rtm.TxBegin(); status == rtm.TxBeginStarted {
+		if m.rw.IsLocked() {
+			// Aborts with lockedAbortCode
+			rtm.TxAbort()
+		}
+		return
+	} else if elidedPolicy.shouldRetry(status, attempt) {
+		elidedPolicy.backoff(attempt)
+		for m.rw.IsLocked() {
+			Pause()
+		}
+		goto retry
+	}
+	m.rw.RLock()
+}
+
+// RUnlock ends the read section. An elided section is committed, and a
+// lock that was acquired for reading is released.
+//
+//go:nosplit
+func (m *ElidedRWMutex) RUnlock() {
+	if xtest() {
+		rtm.TxEnd()
+		return
+	}
+	m.rw.RUnlock()
+}
@@ -0,0 +1,15 @@
+//go:build !amd64 || race
+// +build !amd64 race
+
+package safetyfast
+
+// RLock acquires the lock for reading.
+// RTM is not available, so the lock is never elided.
+func (m *ElidedRWMutex) RLock() {
+	m.rw.RLock()
+}
+
+// RUnlock releases the lock for reading.
+func (m *ElidedRWMutex) RUnlock() {
+	m.rw.RUnlock()
+}
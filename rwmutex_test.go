@@ -0,0 +1,184 @@
+package safetyfast
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rwTryLocker is a reader-writer mutex that can attempt to acquire the lock
+// without waiting.
+type rwTryLocker interface {
+	RWLocker
+	TryLock() bool
+	TryRLock() bool
+	IsLocked() bool
+}
+
+func TestSpinRWMutex(t *testing.T) {
+	run := func(t *testing.T, m rwTryLocker) {
+		t.Run("Readers", func(t *testing.T) {
+			if !m.TryRLock() {
+				t.Fatal("TryRLock failed on a free lock")
+			}
+			if !m.TryRLock() {
+				t.Fatal("TryRLock failed while only readers held the lock")
+			}
+			if m.TryLock() {
+				t.Error("TryLock succeeded while readers held the lock")
+			}
+			if m.IsLocked() {
+				t.Error("IsLocked reported a writer while only readers held the lock")
+			}
+			m.RUnlock()
+			m.RUnlock()
+			if !m.TryLock() {
+				t.Fatal("TryLock failed after all readers released the lock")
+			}
+			m.Unlock()
+		})
+
+		t.Run("Writer", func(t *testing.T) {
+			m.Lock()
+			if !m.IsLocked() {
+				t.Error("IsLocked reported false for a held lock")
+			}
+			if m.TryRLock() {
+				t.Error("TryRLock succeeded while a writer held the lock")
+			}
+			if m.TryLock() {
+				t.Error("TryLock succeeded while a writer held the lock")
+			}
+			m.Unlock()
+			if m.IsLocked() {
+				t.Error("IsLocked reported true for a released lock")
+			}
+		})
+
+		t.Run("WriterPreferred", func(t *testing.T) {
+			oldmaxprocs := runtime.GOMAXPROCS(2)
+			defer runtime.GOMAXPROCS(oldmaxprocs)
+
+			m.RLock()
+			locked := make(chan struct{})
+			go func() {
+				m.Lock()
+				close(locked)
+			}()
+			// Wait until the writer is waiting for the reader
+			for !m.IsLocked() {
+				runtime.Gosched()
+			}
+			if m.TryRLock() {
+				t.Error("TryRLock succeeded while a writer waited for the lock")
+			}
+			select {
+			case <-locked:
+				t.Fatal("Lock returned while a reader held the lock")
+			default:
+			}
+			m.RUnlock()
+			<-locked
+			m.Unlock()
+		})
+
+		t.Run("Concurrent", func(t *testing.T) {
+			const numWriters = 2
+			const numReaders = 6
+			const numIterations = 100000 / raceScale
+
+			oldmaxprocs := runtime.GOMAXPROCS(numWriters + numReaders)
+			defer runtime.GOMAXPROCS(oldmaxprocs)
+
+			var wg sync.WaitGroup
+			var a, b int
+			var torn int32
+
+			wg.Add(numWriters + numReaders)
+			for i := 0; i < numWriters; i++ {
+				go func() {
+					for i := 0; i < numIterations; i++ {
+						m.Lock()
+						a++
+						b++
+						m.Unlock()
+					}
+					wg.Done()
+				}()
+			}
+			for i := 0; i < numReaders; i++ {
+				go func() {
+					for i := 0; i < numIterations; i++ {
+						m.RLock()
+						if a != b {
+							torn = 1
+						}
+						m.RUnlock()
+					}
+					wg.Done()
+				}()
+			}
+			wg.Wait()
+
+			if torn != 0 {
+				t.Fatal("A reader observed a partially applied writer")
+			}
+			if expected := numWriters * numIterations; a != expected || b != expected {
+				t.Fatalf("Counters are %d and %d, but we expected %d", a, b, expected)
+			}
+		})
+	}
+
+	t.Run("SpinRWMutex", func(t *testing.T) {
+		run(t, new(SpinRWMutex))
+	})
+
+	t.Run("ElidedRWMutex", func(t *testing.T) {
+		run(t, new(ElidedRWMutex))
+	})
+}
+
+func TestSpinRWMutexRLocker(t *testing.T) {
+	var m SpinRWMutex
+	r := m.RLocker()
+	r.Lock()
+	if m.TryLock() {
+		t.Error("TryLock succeeded while RLocker held the lock")
+	}
+	r.Unlock()
+	if !m.TryLock() {
+		t.Error("TryLock failed after RLocker released the lock")
+	}
+	m.Unlock()
+}
+
+func TestSpinRWMutexLockTimeoutReaders(t *testing.T) {
+	var m SpinRWMutex
+	m.RLock()
+	if m.LockTimeout(10 * time.Millisecond) {
+		t.Error("LockTimeout succeeded while a reader held the lock")
+	}
+	// A writer that gave up must let readers in again
+	if !m.TryRLock() {
+		t.Error("TryRLock failed after LockTimeout gave up")
+	}
+	m.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.LockContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("LockContext returned %v while a reader held the lock instead of %v", err, context.DeadlineExceeded)
+	}
+
+	// The reader leaves while the writer waits
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		m.RUnlock()
+	}()
+	if !m.LockTimeout(time.Minute) {
+		t.Error("LockTimeout failed on a lock that the reader released")
+	}
+	m.Unlock()
+}
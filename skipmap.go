@@ -0,0 +1,277 @@
+package safetyfast
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// skipMapMaxLevel is the maximum height of a SkipMap tower, which keeps the
+// expected search cost logarithmic for up to 4^skipMapMaxLevel entries.
+const skipMapMaxLevel = 24
+
+// skipMapRangeChunk is the number of entries Range copies within one atomic
+// section, which bounds the footprint of its transactions.
+const skipMapRangeChunk = 32
+
+// skipNode is an entry of a SkipMap, linked into the first len(next) levels.
+type skipNode[K, V any] struct {
+	key  K
+	val  V
+	next []*skipNode[K, V]
+}
+
+// SkipMap is an ordered map that is safe for concurrent use, based on a
+// skip list.
+//
+// Every operation runs as a single atomic section of its context, so an
+// insert or delete relinks all levels of the list at once. When the context
+// uses RTM, operations only conflict if one of them writes a link the other
+// one reads, and fall back to the context's lock on conflicts. Since every
+// operation starts at the head, inserting or deleting a tower that is
+// linked to the head on its upper levels conflicts with most concurrent
+// operations, and changing the number of levels in use conflicts with all
+// of them. With towers of random height, this only happens to a small
+// fraction of updates. Nodes are allocated before a section is entered, so
+// that transactions never allocate.
+type SkipMap[K, V any] struct {
+	// len must be first, to be 64 bit aligned on 32 bit architectures.
+	// It is updated after an insert or delete, outside of the atomic
+	// section, so that it is not part of any transaction.
+	len int64
+	// Keep len out of the cache lines read by the transactions
+	_    [128]byte
+	ctx  AtomicContext
+	less func(a, b K) bool
+	head skipNode[K, V]
+	// Keep level on its own cache lines, since it is read by every
+	// operation, but written when the number of levels changes
+	_ [128]byte
+	// level is the number of levels in use
+	level int
+	_     [128]byte
+}
+
+// NewSkipMap creates a SkipMap ordered by less, using NewAutoContext.
+// For ordered key types, less can be func(a, b K) bool { return a < b }.
+func NewSkipMap[K, V any](less func(a, b K) bool) *SkipMap[K, V] {
+	return NewSkipMapContext[K, V](less, NewAutoContext())
+}
+
+// NewSkipMapContext creates a SkipMap ordered by less, using c to run its
+// operations atomically.
+func NewSkipMapContext[K, V any](less func(a, b K) bool, c AtomicContext) *SkipMap[K, V] {
+	m := &SkipMap[K, V]{
+		ctx:   c,
+		less:  less,
+		level: 1,
+	}
+	m.head.next = make([]*skipNode[K, V], skipMapMaxLevel)
+	return m
+}
+
+// randomLevel returns the height of a new tower, where each level is
+// present with probability 1/4.
+func randomLevel() int {
+	level := 1
+	for r := rand.Uint64(); level < skipMapMaxLevel && r&3 == 0; r >>= 2 {
+		level++
+	}
+	return level
+}
+
+// read executes reader atomically, with the read lock if the context
+// supports it.
+func (m *SkipMap[K, V]) read(reader func()) {
+	if rc, ok := m.ctx.(RWAtomicContext); ok {
+		rc.AtomicRead(reader)
+		return
+	}
+	m.ctx.Atomic(reader)
+}
+
+// findPreds fills preds with the last node before k on each level in use,
+// and returns the node following it on the bottom level.
+func (m *SkipMap[K, V]) findPreds(k K, preds *[skipMapMaxLevel]*skipNode[K, V]) *skipNode[K, V] {
+	x := &m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && m.less(x.next[i].key, k) {
+			x = x.next[i]
+		}
+		preds[i] = x
+	}
+	return x.next[0]
+}
+
+// ceiling returns the first node with a key of at least k.
+func (m *SkipMap[K, V]) ceiling(k K) *skipNode[K, V] {
+	x := &m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && m.less(x.next[i].key, k) {
+			x = x.next[i]
+		}
+	}
+	return x.next[0]
+}
+
+// after returns the first node with a key greater than k.
+func (m *SkipMap[K, V]) after(k K) *skipNode[K, V] {
+	x := &m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && !m.less(k, x.next[i].key) {
+			x = x.next[i]
+		}
+	}
+	return x.next[0]
+}
+
+// equal reports if a and b are ordered equally.
+func (m *SkipMap[K, V]) equal(a, b K) bool {
+	return !m.less(a, b) && !m.less(b, a)
+}
+
+// Len returns the number of entries in the map.
+// The count is updated right after each insert or delete, so it may not
+// yet include Put and Delete calls that have not returned.
+func (m *SkipMap[K, V]) Len() int {
+	return int(atomic.LoadInt64(&m.len))
+}
+
+// Get returns the value stored for k, and reports if k was present.
+func (m *SkipMap[K, V]) Get(k K) (V, bool) {
+	var val V
+	var ok bool
+	m.read(func() {
+		if x := m.ceiling(k); x != nil && !m.less(k, x.key) {
+			val, ok = x.val, true
+		}
+	})
+	return val, ok
+}
+
+// Put stores val for k. It reports if k was newly inserted.
+func (m *SkipMap[K, V]) Put(k K, val V) bool {
+	// Allocate the node up front, so that the transaction does not allocate
+	n := &skipNode[K, V]{
+		key:  k,
+		val:  val,
+		next: make([]*skipNode[K, V], randomLevel()),
+	}
+	var inserted bool
+	m.ctx.Atomic(func() {
+		var preds [skipMapMaxLevel]*skipNode[K, V]
+		if x := m.findPreds(k, &preds); x != nil && m.equal(k, x.key) {
+			x.val = val
+			inserted = false
+			return
+		}
+		for m.level < len(n.next) {
+			preds[m.level] = &m.head
+			m.level++
+		}
+		for i := range n.next {
+			n.next[i] = preds[i].next[i]
+			preds[i].next[i] = n
+		}
+		inserted = true
+	})
+	if inserted {
+		atomic.AddInt64(&m.len, 1)
+	}
+	return inserted
+}
+
+// Delete removes k from the map, and reports if k was present.
+func (m *SkipMap[K, V]) Delete(k K) bool {
+	var found bool
+	m.ctx.Atomic(func() {
+		var preds [skipMapMaxLevel]*skipNode[K, V]
+		x := m.findPreds(k, &preds)
+		found = x != nil && m.equal(k, x.key)
+		if !found {
+			return
+		}
+		for i := range x.next {
+			preds[i].next[i] = x.next[i]
+		}
+		for m.level > 1 && m.head.next[m.level-1] == nil {
+			m.level--
+		}
+	})
+	if found {
+		atomic.AddInt64(&m.len, -1)
+	}
+	return found
+}
+
+// Floor returns the entry with the greatest key less than or equal to k,
+// and reports if there is one.
+func (m *SkipMap[K, V]) Floor(k K) (K, V, bool) {
+	var key K
+	var val V
+	var ok bool
+	m.read(func() {
+		x := &m.head
+		for i := m.level - 1; i >= 0; i-- {
+			for x.next[i] != nil && !m.less(k, x.next[i].key) {
+				x = x.next[i]
+			}
+		}
+		if ok = x != &m.head; ok {
+			key, val = x.key, x.val
+		}
+	})
+	return key, val, ok
+}
+
+// Ceiling returns the entry with the least key greater than or equal to k,
+// and reports if there is one.
+func (m *SkipMap[K, V]) Ceiling(k K) (K, V, bool) {
+	var key K
+	var val V
+	var ok bool
+	m.read(func() {
+		if x := m.ceiling(k); x != nil {
+			key, val, ok = x.key, x.val, true
+		}
+	})
+	return key, val, ok
+}
+
+// Range calls fn for each entry with a key from from, inclusive, to to,
+// exclusive, in ascending order, until fn returns false.
+// Entries are copied in chunks, each within its own atomic section, and fn
+// is called outside of the sections, so fn may modify the map. Each chunk is
+// consistent, but entries changed between chunks may or may not be seen.
+func (m *SkipMap[K, V]) Range(from, to K, fn func(k K, val V) bool) {
+	keys := make([]K, 0, skipMapRangeChunk)
+	vals := make([]V, 0, skipMapRangeChunk)
+	first := true
+	for {
+		var last K
+		if len(keys) > 0 {
+			last = keys[len(keys)-1]
+		}
+		m.read(func() {
+			keys, vals = keys[:0], vals[:0]
+			var x *skipNode[K, V]
+			if first {
+				x = m.ceiling(from)
+			} else {
+				x = m.after(last)
+			}
+			for ; x != nil && len(keys) < cap(keys) && m.less(x.key, to); x = x.next[0] {
+				keys = append(keys, x.key)
+				vals = append(vals, x.val)
+			}
+		})
+		first = false
+		for i := range keys {
+			if !fn(keys[i], vals[i]) {
+				return
+			}
+		}
+		if len(keys) < cap(keys) {
+			return
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package safetyfast
+
+import (
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func intLess(a, b int) bool {
+	return a < b
+}
+
+func TestSkipMap(t *testing.T) {
+	m := NewSkipMap[int, string](intLess)
+	if _, ok := m.Get(1); ok {
+		t.Error("Get found a key in an empty map")
+	}
+	if _, _, ok := m.Floor(1); ok {
+		t.Error("Floor found a key in an empty map")
+	}
+	for _, k := range []int{30, 10, 20} {
+		if !m.Put(k, "v") {
+			t.Errorf("Put did not insert %d", k)
+		}
+	}
+	if m.Put(20, "w") {
+		t.Error("Put inserted an existing key")
+	}
+	if v, ok := m.Get(20); !ok || v != "w" {
+		t.Errorf("Get returned %q, %v instead of \"w\", true", v, ok)
+	}
+	if m.Len() != 3 {
+		t.Errorf("Len returned %d instead of 3", m.Len())
+	}
+
+	tests := []struct {
+		k           int
+		floor, ceil int
+		fok, cok    bool
+	}{
+		{5, 0, 10, false, true},
+		{10, 10, 10, true, true},
+		{15, 10, 20, true, true},
+		{30, 30, 30, true, true},
+		{35, 30, 0, true, false},
+	}
+	for _, test := range tests {
+		if k, _, ok := m.Floor(test.k); k != test.floor || ok != test.fok {
+			t.Errorf("Floor(%d) returned %d, %v instead of %d, %v", test.k, k, ok, test.floor, test.fok)
+		}
+		if k, _, ok := m.Ceiling(test.k); k != test.ceil || ok != test.cok {
+			t.Errorf("Ceiling(%d) returned %d, %v instead of %d, %v", test.k, k, ok, test.ceil, test.cok)
+		}
+	}
+
+	if !m.Delete(20) || m.Delete(20) {
+		t.Error("Delete did not remove 20 exactly once")
+	}
+	if _, ok := m.Get(20); ok {
+		t.Error("Get found a deleted key")
+	}
+	if k, _, _ := m.Floor(25); k != 10 {
+		t.Errorf("Floor(25) returned %d instead of 10 after deleting 20", k)
+	}
+}
+
+// TestSkipMapRandom checks a SkipMap against a Go map, under a random mix
+// of operations, and checks ranges that span several chunks.
+func TestSkipMapRandom(t *testing.T) {
+	m := NewSkipMap[int, int](intLess)
+	expected := make(map[int]int)
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 50000; i++ {
+		k := r.Intn(1000)
+		switch r.Intn(3) {
+		case 0:
+			_, ok := expected[k]
+			if m.Put(k, i) == ok {
+				t.Fatalf("Put(%d) did not report %v", k, !ok)
+			}
+			expected[k] = i
+		case 1:
+			_, ok := expected[k]
+			if m.Delete(k) != ok {
+				t.Fatalf("Delete(%d) did not report %v", k, ok)
+			}
+			delete(expected, k)
+		case 2:
+			v, ok := m.Get(k)
+			if ev, eok := expected[k]; v != ev || ok != eok {
+				t.Fatalf("Get(%d) returned %v, %v instead of %v, %v", k, v, ok, ev, eok)
+			}
+		}
+	}
+
+	if m.Len() != len(expected) {
+		t.Errorf("Len returned %d instead of %d", m.Len(), len(expected))
+	}
+
+	var keys []int
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	for _, bounds := range [][2]int{{0, 1000}, {100, 400}, {500, 500}, {-5, 3}} {
+		var want []int
+		for _, k := range keys {
+			if k >= bounds[0] && k < bounds[1] {
+				want = append(want, k)
+			}
+		}
+		var got []int
+		m.Range(bounds[0], bounds[1], func(k, v int) bool {
+			if v != expected[k] {
+				t.Errorf("Range returned %d: %d instead of %d", k, v, expected[k])
+			}
+			got = append(got, k)
+			return true
+		})
+		if len(got) != len(want) {
+			t.Fatalf("Range(%d, %d) returned %d keys instead of %d", bounds[0], bounds[1], len(got), len(want))
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("Range(%d, %d) returned %d at index %d instead of %d", bounds[0], bounds[1], got[i], i, want[i])
+			}
+		}
+	}
+
+	var count int
+	m.Range(0, 1000, func(k, v int) bool {
+		count++
+		return count < 50
+	})
+	if count != 50 {
+		t.Errorf("Range called fn %d times after it returned false, instead of stopping at 50", count)
+	}
+}
+
+func TestSkipMapConcurrent(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const numKeys = 1000
+	const numIterations = 20000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	run := func(t *testing.T, m *SkipMap[int, int]) {
+		// Each goroutine owns the keys equal to its index modulo the number
+		// of goroutines, so it knows which of them are present
+		var wg sync.WaitGroup
+		present := make([]map[int]bool, numConcurGoRoutines)
+		wg.Add(numConcurGoRoutines)
+		for g := 0; g < numConcurGoRoutines; g++ {
+			present[g] = make(map[int]bool)
+			go func(g int) {
+				r := rand.New(rand.NewSource(int64(g)))
+				for i := 0; i < numIterations; i++ {
+					k := r.Intn(numKeys/numConcurGoRoutines)*numConcurGoRoutines + g
+					if r.Intn(2) == 0 {
+						m.Put(k, k)
+						present[g][k] = true
+					} else {
+						m.Delete(k)
+						delete(present[g], k)
+					}
+				}
+				wg.Done()
+			}(g)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+			prev := -1
+			m.Range(0, numKeys, func(k, v int) bool {
+				if k <= prev || k != v {
+					t.Errorf("Range returned %d: %d after %d", k, v, prev)
+				}
+				prev = k
+				return true
+			})
+		}
+
+		var expected int
+		for g := range present {
+			expected += len(present[g])
+		}
+		var count int
+		m.Range(0, numKeys, func(k, v int) bool {
+			if !present[k%numConcurGoRoutines][k] {
+				t.Errorf("Range returned deleted key %d", k)
+			}
+			count++
+			return true
+		})
+		if count != expected || m.Len() != expected {
+			t.Errorf("Range returned %d keys and Len %d, but we expected %d", count, m.Len(), expected)
+		}
+	}
+
+	t.Run("AutoContext", func(t *testing.T) {
+		run(t, NewSkipMap[int, int](intLess))
+	})
+
+	t.Run("RTMContext", func(t *testing.T) {
+		run(t, NewSkipMapContext[int, int](intLess, NewRTMContex(new(SpinMutex))))
+	})
+
+	t.Run("Faults", func(t *testing.T) {
+		run(t, NewSkipMapContext[int, int](intLess, newRTMContextFaults(new(SpinMutex), faultSequence(AbortConflict))))
+	})
+}
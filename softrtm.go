@@ -0,0 +1,425 @@
+package safetyfast
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultSoftCapacity is the default number of distinct words a
+// SoftRTMContext transaction may read and write, before it aborts with
+// AbortCapacity.
+// It matches the number of cache lines in a typical 32KiB L1 data cache,
+// which bounds the footprint of a hardware transaction.
+const DefaultSoftCapacity = 512
+
+// softIndexThreshold is the read or write set size above which the set is
+// indexed by a map, instead of searched linearly.
+const softIndexThreshold = 16
+
+// SoftRTMContext is a software transactional memory that emulates the
+// semantics of an RTMContext, including its abort status codes, retry
+// policy, and statistics.
+//
+// It implements the NOrec algorithm, which uses a single sequence lock per
+// context and validates transactions by value. Only memory accessed through
+// the Tx handle's Load and Store methods is tracked, so only AtomicTx runs
+// commiters as transactions. Commiters launched using Atomic, AtomicRead or
+// TryAtomic can not be tracked, so they always run irrevocably, as if they
+// had taken the fallback path. They never abort or retry, and only count as
+// fallbacks in the statistics. To exercise the conflict, abort and retry
+// handling of a commiter, it must be written against the Tx handle and
+// launched using AtomicTx.
+//
+// An irrevocable commiter waits until all speculative transactions of the
+// context aborted, before it runs. It may therefore access the same memory
+// as AtomicTx commiters using plain loads and stores, but it must not be
+// launched from within an AtomicTx commiter of the same context.
+type SoftRTMContext struct {
+	// seq must be first, to be 64 bit aligned on 32 bit architectures.
+	// It is odd while a transaction is writing back or an irrevocable
+	// commiter is running.
+	seq uint64
+	// stats is 64 bit aligned, since seq is 64 bits
+	stats rtmStats
+	// fallback is set while an irrevocable commiter is running
+	fallback int32
+	// active is the number of speculative transactions being attempted
+	active int32
+	policy rtmPolicy
+	pool   sync.Pool
+}
+
+// softAbort is the panic value used to unwind an aborted soft or simulated
+// transaction.
+type softAbort uint32
+
+// softEntry is a word in a read or write set.
+type softEntry struct {
+	addr *uint64
+	val  uint64
+}
+
+// softTx is the state of a single SoftRTMContext transaction.
+type softTx struct {
+	ctx         *SoftRTMContext
+	snapshot    uint64
+	irrevocable bool
+	reads       []softEntry
+	writes      []softEntry
+	rindex      map[*uint64]int
+	windex      map[*uint64]int
+	// words is the number of distinct words read or written
+	words int
+}
+
+// NewSoftRTMContext creates a SoftRTMContext.
+// The retry policy and capacity can be tuned using opts.
+func NewSoftRTMContext(opts ...RTMOption) *SoftRTMContext {
+	s := &SoftRTMContext{
+		policy: newRTMPolicy(opts),
+	}
+	s.pool.New = func() interface{} {
+		return &softTx{ctx: s}
+	}
+	return s
+}
+
+// WithCapacity sets the number of distinct words a SoftRTMContext
+// transaction may read and write, before it aborts with AbortCapacity.
+// It has no effect on an RTMContext, since the capacity of a hardware
+// transaction is determined by the CPU.
+func WithCapacity(words int) RTMOption {
+	return func(p *rtmPolicy) {
+		p.softCapacity = words
+	}
+}
+
+func (t *softTx) abort(status uint32) {
+	panic(softAbort(status))
+}
+
+// begin waits for any write back to finish and takes a snapshot of the
+// sequence lock. It aborts if an irrevocable commiter is running.
+func (t *softTx) begin() {
+	for {
+		s := atomic.LoadUint64(&t.ctx.seq)
+		if s&1 == 0 {
+			t.snapshot = s
+			return
+		}
+		if atomic.LoadInt32(&t.ctx.fallback) != 0 {
+			t.abort(AbortExplicit | lockedAbortCode<<24)
+		}
+		Pause()
+	}
+}
+
+// validate checks that all words read so far still hold the values that
+// were read, and returns the sequence number the check is consistent with.
+func (t *softTx) validate() uint64 {
+	for {
+		s := atomic.LoadUint64(&t.ctx.seq)
+		if s&1 != 0 {
+			if atomic.LoadInt32(&t.ctx.fallback) != 0 {
+				t.abort(AbortExplicit | lockedAbortCode<<24)
+			}
+			Pause()
+			continue
+		}
+		for _, r := range t.reads {
+			if atomic.LoadUint64(r.addr) != r.val {
+				t.abort(AbortConflict | AbortRetry)
+			}
+		}
+		if s == atomic.LoadUint64(&t.ctx.seq) {
+			return s
+		}
+	}
+}
+
+// addWord counts a word that was not read or written before, and aborts
+// with AbortCapacity once the transaction holds too many words.
+func (t *softTx) addWord() {
+	t.words++
+	if t.words > t.ctx.policy.softCapacity {
+		t.abort(AbortCapacity)
+	}
+}
+
+// lookupEntry returns the position of addr in set, which is indexed by
+// index once it grew above softIndexThreshold.
+func lookupEntry(set []softEntry, index map[*uint64]int, addr *uint64) (int, bool) {
+	if index != nil {
+		i, ok := index[addr]
+		return i, ok
+	}
+	for i := range set {
+		if set[i].addr == addr {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// appendEntry appends e to set, and indexes the set once it grows above
+// softIndexThreshold.
+func appendEntry(set *[]softEntry, index *map[*uint64]int, e softEntry) {
+	*set = append(*set, e)
+	if *index != nil {
+		(*index)[e.addr] = len(*set) - 1
+	} else if len(*set) > softIndexThreshold {
+		*index = make(map[*uint64]int, len(*set))
+		for i := range *set {
+			(*index)[(*set)[i].addr] = i
+		}
+	}
+}
+
+func (t *softTx) load(addr *uint64) uint64 {
+	if t.irrevocable {
+		return atomic.LoadUint64(addr)
+	}
+	if i, ok := lookupEntry(t.writes, t.windex, addr); ok {
+		return t.writes[i].val
+	}
+	// Each word is only read once, like RTM tracks each cache line once, so
+	// that repeated reads do not count against the capacity. Validation
+	// ensures the word still holds the value read.
+	if i, ok := lookupEntry(t.reads, t.rindex, addr); ok {
+		return t.reads[i].val
+	}
+	v := atomic.LoadUint64(addr)
+	for t.snapshot != atomic.LoadUint64(&t.ctx.seq) {
+		t.snapshot = t.validate()
+		v = atomic.LoadUint64(addr)
+	}
+	appendEntry(&t.reads, &t.rindex, softEntry{addr, v})
+	t.addWord()
+	return v
+}
+
+func (t *softTx) store(addr *uint64, val uint64) {
+	if t.irrevocable {
+		atomic.StoreUint64(addr, val)
+		return
+	}
+	if i, ok := lookupEntry(t.writes, t.windex, addr); ok {
+		t.writes[i].val = val
+		return
+	}
+	appendEntry(&t.writes, &t.windex, softEntry{addr, val})
+	if _, ok := lookupEntry(t.reads, t.rindex, addr); !ok {
+		t.addWord()
+	}
+}
+
+// commit writes back the write set, while holding the sequence lock.
+// Read-only transactions were already validated by their last load.
+func (t *softTx) commit() {
+	if len(t.writes) == 0 {
+		return
+	}
+	for !atomic.CompareAndSwapUint64(&t.ctx.seq, t.snapshot, t.snapshot+1) {
+		t.snapshot = t.validate()
+	}
+	for _, w := range t.writes {
+		atomic.StoreUint64(w.addr, w.val)
+	}
+	atomic.StoreUint64(&t.ctx.seq, t.snapshot+2)
+}
+
+func (t *softTx) reset() {
+	t.reads = t.reads[:0]
+	t.writes = t.writes[:0]
+	t.rindex = nil
+	t.windex = nil
+	t.words = 0
+	t.irrevocable = false
+}
+
+// speculate runs commiter as a software transaction and returns the
+// status of the attempt, which is softCommitted if it committed.
+func (s *SoftRTMContext) speculate(tx *Tx, commiter func(tx *Tx)) (status uint32) {
+	// An irrevocable commiter that starts after active was incremented
+	// waits for this attempt to abort, and one that already started makes
+	// begin abort
+	atomic.AddInt32(&s.active, 1)
+	defer func() {
+		atomic.AddInt32(&s.active, -1)
+		if v := recover(); v != nil {
+			a, ok := v.(softAbort)
+			if !ok {
+				panic(v)
+			}
+			status = uint32(a)
+		}
+	}()
+	tx.soft.reset()
+	tx.soft.begin()
+	commiter(tx)
+	tx.soft.commit()
+	return softCommitted
+}
+
+// softCommitted is the status returned by speculate for a committed
+// transaction. It mirrors the status RTM reports for a started transaction,
+// which can never be confused with an abort status.
+const softCommitted = ^uint32(0)
+
+// retry records the aborted attempt'th attempt and reports if the
+// transaction should be attempted again, after backing off.
+func (s *SoftRTMContext) retry(status uint32, attempt int) bool {
+	s.stats.abort(status)
+	if !s.policy.shouldRetry(status, attempt) {
+		return false
+	}
+	s.policy.backoff(attempt)
+	if s.policy.waitForFallback {
+		for atomic.LoadInt32(&s.fallback) != 0 {
+			Pause()
+		}
+	}
+	return true
+}
+
+// lock acquires the sequence lock for an irrevocable commiter and returns
+// the sequence number to release it with.
+func (s *SoftRTMContext) lock() uint64 {
+	for {
+		for attempts := LockAttempts; attempts > 0; attempts-- {
+			seq := atomic.LoadUint64(&s.seq)
+			if seq&1 == 0 && atomic.CompareAndSwapUint64(&s.seq, seq, seq+1) {
+				atomic.StoreInt32(&s.fallback, 1)
+				s.waitSpeculators()
+				return seq
+			}
+			Pause()
+		}
+		// Invoke scheduler to allow other to run
+		runtime.Gosched()
+	}
+}
+
+// tryLock attempts to acquire the sequence lock once, without waiting.
+// It fails while speculative transactions are running, since they would
+// have to abort before an irrevocable commiter could run.
+func (s *SoftRTMContext) tryLock() (uint64, bool) {
+	seq := atomic.LoadUint64(&s.seq)
+	if seq&1 != 0 || !atomic.CompareAndSwapUint64(&s.seq, seq, seq+1) {
+		return 0, false
+	}
+	// Transactions that begin from now on wait for the odd sequence number,
+	// so only those that began before need to be checked
+	if atomic.LoadInt32(&s.active) != 0 {
+		// Nothing was written, so the transactions remain valid
+		atomic.StoreUint64(&s.seq, seq)
+		return 0, false
+	}
+	atomic.StoreInt32(&s.fallback, 1)
+	return seq, true
+}
+
+// waitSpeculators waits until all speculative transactions aborted, after
+// the sequence lock was acquired for an irrevocable commiter. Transactions
+// abort on their next load or commit, once they see the fallback flag, so
+// afterwards no transaction reads memory the commiter writes.
+func (s *SoftRTMContext) waitSpeculators() {
+	attempts := LockAttempts
+	for atomic.LoadInt32(&s.active) != 0 {
+		Pause()
+		if attempts--; attempts == 0 {
+			attempts = LockAttempts
+			// Invoke scheduler to allow the transactions to run
+			runtime.Gosched()
+		}
+	}
+}
+
+func (s *SoftRTMContext) unlock(seq uint64) {
+	atomic.StoreInt32(&s.fallback, 0)
+	atomic.StoreUint64(&s.seq, seq+2)
+}
+
+// AtomicTx executes the commiter as a software transaction, while giving it
+// a Tx handle. Only words accessed using tx.Load and tx.Store are part of the
+// transaction. If the transaction aborts and the retry policy gives up, the
+// commiter is run irrevocably.
+func (s *SoftRTMContext) AtomicTx(commiter func(tx *Tx)) {
+	t := s.pool.Get().(*softTx)
+	tx := Tx{soft: t}
+	var attempt int
+	for {
+		tx.attempt = attempt
+		attempt++
+		status := s.speculate(&tx, commiter)
+		if status == softCommitted {
+			s.stats.commit()
+			break
+		}
+		if !s.retry(status, attempt) {
+			s.stats.fallback()
+			tx.attempt = attempt
+			tx.fallback = true
+			t.reset()
+			t.irrevocable = true
+			seq := s.lock()
+			commiter(&tx)
+			s.unlock(seq)
+			break
+		}
+	}
+	t.reset()
+	s.pool.Put(t)
+}
+
+// Atomic executes the commiter in an atomic fasion.
+// Memory accessed by commiter can not be tracked, so it is always run
+// irrevocably, which excludes all other commiters launched from this context,
+// including speculative AtomicTx transactions.
+func (s *SoftRTMContext) Atomic(commiter func()) {
+	s.stats.fallback()
+	seq := s.lock()
+	commiter()
+	s.unlock(seq)
+}
+
+// AtomicRead executes the reader in an atomic fasion.
+// Memory accessed by reader can not be tracked, so it is always run
+// irrevocably, like Atomic.
+func (s *SoftRTMContext) AtomicRead(reader func()) {
+	s.Atomic(reader)
+}
+
+// TryAtomic executes the commiter in an atomic fasion, but only if it can
+// be done without waiting. It reports if commiter was executed.
+// Like Atomic, the commiter runs irrevocably, so it is not executed while
+// any other commiter, including a speculative AtomicTx transaction, is
+// running.
+func (s *SoftRTMContext) TryAtomic(commiter func()) bool {
+	seq, ok := s.tryLock()
+	if !ok {
+		return false
+	}
+	s.stats.fallback()
+	commiter()
+	s.unlock(seq)
+	return true
+}
+
+// AtomicErr executes commiter in an atomic fasion, and returns the
+// commiter's error.
+// Note that returning an error does not undo any changes commiter has made.
+func (s *SoftRTMContext) AtomicErr(commiter func() error) error {
+	return DoErr(s, commiter)
+}
+
+// Stats returns a snapshot of the transaction statistics of this context.
+func (s *SoftRTMContext) Stats() RTMStats {
+	return s.stats.snapshot()
+}
+
+// Reset sets all transaction statistics of this context to zero.
+func (s *SoftRTMContext) Reset() {
+	s.stats.reset()
+}
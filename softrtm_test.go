@@ -0,0 +1,376 @@
+package safetyfast
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSoftRTMContext(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const arrayLength = 100
+	const numIterations = 100000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	var wg sync.WaitGroup
+	var arr = make([]uint64, arrayLength)
+	var c = NewSoftRTMContext()
+
+	routine := func() {
+		randsrc := rand.NewSource(int64(time.Now().Second()))
+		r := rand.New(randsrc)
+
+		for i := 0; i < numIterations; i++ {
+			index := r.Int() % len(arr)
+			c.AtomicTx(func(tx *Tx) {
+				tx.Store(&arr[index], tx.Load(&arr[index])+1)
+			})
+		}
+		wg.Done()
+	}
+
+	wg.Add(numConcurGoRoutines)
+	for i := 0; i < numConcurGoRoutines; i++ {
+		go routine()
+	}
+	wg.Wait()
+
+	var sum uint64
+	for _, v := range arr {
+		sum += v
+	}
+
+	expected := uint64(numIterations * numConcurGoRoutines)
+	stats := c.Stats()
+	t.Logf("Commits=%d | Fallbacks=%d | Aborts=%d | ConflictAborts=%d",
+		stats.Commits, stats.Fallbacks, stats.Aborts, stats.Conflict)
+	if sum != expected {
+		t.Fatalf("Sum result is %d, but we expected %d", sum, expected)
+	}
+	if executions := stats.Commits + stats.Fallbacks; executions != expected {
+		t.Fatalf("Commits+Fallbacks is %d, but we expected %d", executions, expected)
+	}
+}
+
+func TestSoftRTMContextAborts(t *testing.T) {
+	t.Run("Capacity", func(t *testing.T) {
+		c := NewSoftRTMContext(WithCapacity(4))
+		var arr [8]uint64
+		c.AtomicTx(func(tx *Tx) {
+			for i := range arr {
+				tx.Store(&arr[i], tx.Load(&arr[i])+1)
+			}
+		})
+		for i, v := range arr {
+			if v != 1 {
+				t.Errorf("arr[%d] is %d instead of 1", i, v)
+			}
+		}
+		stats := c.Stats()
+		if stats.Capacity != 1 || stats.Fallbacks != 1 || stats.Commits != 0 {
+			t.Errorf("Capacity=%d Fallbacks=%d Commits=%d, but we expected 1, 1 and 0",
+				stats.Capacity, stats.Fallbacks, stats.Commits)
+		}
+	})
+
+	t.Run("RepeatedReads", func(t *testing.T) {
+		// Like RTM, the capacity counts distinct words, not accesses
+		c := NewSoftRTMContext(WithCapacity(8))
+		var x uint64 = 1
+		var sum uint64
+		c.AtomicTx(func(tx *Tx) {
+			sum = 0
+			for i := 0; i < 20; i++ {
+				sum += tx.Load(&x)
+			}
+			tx.Store(&x, sum)
+		})
+		if sum != 20 || x != 20 {
+			t.Errorf("sum is %d and x is %d instead of 20 and 20", sum, x)
+		}
+		stats := c.Stats()
+		if stats.Capacity != 0 || stats.Fallbacks != 0 || stats.Commits != 1 {
+			t.Errorf("Capacity=%d Fallbacks=%d Commits=%d, but we expected 0, 0 and 1",
+				stats.Capacity, stats.Fallbacks, stats.Commits)
+		}
+	})
+
+	t.Run("IndexedReads", func(t *testing.T) {
+		// Enough distinct words to index the read set
+		c := NewSoftRTMContext(WithCapacity(4 * softIndexThreshold))
+		var arr [2 * softIndexThreshold]uint64
+		for i := range arr {
+			arr[i] = uint64(i)
+		}
+		var sum uint64
+		c.AtomicTx(func(tx *Tx) {
+			sum = 0
+			for n := 0; n < 3; n++ {
+				for i := range arr {
+					sum += tx.Load(&arr[i])
+				}
+			}
+		})
+		if expected := uint64(3 * len(arr) * (len(arr) - 1) / 2); sum != expected {
+			t.Errorf("sum is %d instead of %d", sum, expected)
+		}
+		stats := c.Stats()
+		if stats.Capacity != 0 || stats.Commits != 1 {
+			t.Errorf("Capacity=%d Commits=%d, but we expected 0 and 1", stats.Capacity, stats.Commits)
+		}
+	})
+
+	t.Run("Explicit", func(t *testing.T) {
+		c := NewSoftRTMContext()
+		var x uint64
+		c.AtomicTx(func(tx *Tx) {
+			tx.Store(&x, tx.Load(&x)+1)
+			tx.Abort(7)
+			if tx.InTransaction() {
+				t.Error("InTransaction reported true after an abort")
+			}
+		})
+		if x != 1 {
+			t.Errorf("x is %d instead of 1", x)
+		}
+		stats := c.Stats()
+		if stats.Explicit != 1 || stats.ExplicitCodes[7] != 1 || stats.Fallbacks != 1 {
+			t.Errorf("Explicit=%d ExplicitCodes[7]=%d Fallbacks=%d, but we expected 1, 1 and 1",
+				stats.Explicit, stats.ExplicitCodes[7], stats.Fallbacks)
+		}
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		c := NewSoftRTMContext()
+		var x, y uint64
+		c.AtomicTx(func(tx *Tx) {
+			v := tx.Load(&x)
+			if tx.Attempt() == 0 {
+				// Commit a conflicting write from another goroutine
+				done := make(chan struct{})
+				go c.AtomicTx(func(tx *Tx) {
+					tx.Store(&x, 10)
+					close(done)
+				})
+				<-done
+			}
+			tx.Store(&y, v+tx.Load(&y)+1)
+		})
+		if y != 11 {
+			t.Errorf("y is %d instead of 11", y)
+		}
+		stats := c.Stats()
+		if stats.Conflict != 1 || stats.Commits != 2 {
+			t.Errorf("Conflict=%d Commits=%d, but we expected 1 and 2", stats.Conflict, stats.Commits)
+		}
+	})
+
+	// conflicting commits a write to x from another goroutine, which
+	// conflicts with a transaction that read x
+	conflicting := func(c *SoftRTMContext, x *uint64) {
+		done := make(chan struct{})
+		go c.AtomicTx(func(tx *Tx) {
+			tx.Store(x, tx.Load(x)+1)
+			close(done)
+		})
+		<-done
+	}
+
+	t.Run("Retry", func(t *testing.T) {
+		c := NewSoftRTMContext(WithRetryOn(AbortConflict), WithMaxAttempts(5))
+		var x, y uint64
+		var attempts []int
+		c.AtomicTx(func(tx *Tx) {
+			attempts = append(attempts, tx.Attempt())
+			v := tx.Load(&x)
+			if tx.Attempt() < 2 {
+				conflicting(c, &x)
+			}
+			tx.Store(&y, v)
+		})
+		if len(attempts) != 3 || attempts[2] != 2 {
+			t.Errorf("Commiter ran on attempts %v instead of [0 1 2]", attempts)
+		}
+		if y != 2 {
+			t.Errorf("y is %d instead of 2", y)
+		}
+		stats := c.Stats()
+		if stats.Conflict != 2 || stats.Commits != 3 || stats.Fallbacks != 0 {
+			t.Errorf("Conflict=%d Commits=%d Fallbacks=%d, but we expected 2, 3 and 0",
+				stats.Conflict, stats.Commits, stats.Fallbacks)
+		}
+	})
+
+	t.Run("GiveUp", func(t *testing.T) {
+		c := NewSoftRTMContext(WithRetryOn(AbortConflict), WithMaxAttempts(2))
+		var x, y uint64
+		var fallback bool
+		c.AtomicTx(func(tx *Tx) {
+			v := tx.Load(&x)
+			if tx.InTransaction() {
+				conflicting(c, &x)
+			}
+			fallback = !tx.InTransaction()
+			tx.Store(&y, v)
+		})
+		if !fallback || y != 2 {
+			t.Errorf("Commiter ended with fallback=%v and y=%d instead of true and 2", fallback, y)
+		}
+		stats := c.Stats()
+		if stats.Conflict != 2 || stats.Fallbacks != 1 {
+			t.Errorf("Conflict=%d Fallbacks=%d, but we expected 2 and 1", stats.Conflict, stats.Fallbacks)
+		}
+	})
+
+	t.Run("Irrevocable", func(t *testing.T) {
+		// Only AtomicTx is transactional
+		c := NewSoftRTMContext()
+		var x uint64
+		c.Atomic(func() {
+			x++
+		})
+		c.AtomicRead(func() {
+			_ = x
+		})
+		c.TryAtomic(func() {
+			x++
+		})
+		stats := c.Stats()
+		if stats.Aborts != 0 || stats.Commits != 0 || stats.Fallbacks != 3 {
+			t.Errorf("Aborts=%d Commits=%d Fallbacks=%d, but we expected 0, 0 and 3",
+				stats.Aborts, stats.Commits, stats.Fallbacks)
+		}
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		c := NewSoftRTMContext()
+		defer func() {
+			if v := recover(); v != "test" {
+				t.Errorf("Recovered %v instead of the commiter's panic", v)
+			}
+		}()
+		c.AtomicTx(func(tx *Tx) {
+			panic("test")
+		})
+	})
+}
+
+func TestSoftRTMContextIrrevocable(t *testing.T) {
+	c := NewSoftRTMContext()
+
+	inside := make(chan struct{})
+	done := make(chan struct{})
+	go c.Atomic(func() {
+		close(inside)
+		<-done
+	})
+	<-inside
+
+	if c.TryAtomic(func() {}) {
+		t.Error("TryAtomic executed the commiter while an irrevocable commiter was running")
+	}
+
+	var x uint64
+	finished := make(chan struct{})
+	go func() {
+		c.AtomicTx(func(tx *Tx) {
+			tx.Store(&x, 1)
+		})
+		close(finished)
+	}()
+	close(done)
+	<-finished
+
+	if x != 1 {
+		t.Errorf("x is %d instead of 1", x)
+	}
+	if !c.TryAtomic(func() {}) {
+		t.Error("TryAtomic did not execute the commiter on a free context")
+	}
+
+	// TryAtomic must not wait for a speculative transaction either
+	c.Reset()
+	inside = make(chan struct{})
+	done = make(chan struct{})
+	finished = make(chan struct{})
+	go func() {
+		c.AtomicTx(func(tx *Tx) {
+			if tx.InTransaction() && tx.Attempt() == 0 {
+				close(inside)
+				<-done
+			}
+			tx.Store(&x, tx.Load(&x)+1)
+		})
+		close(finished)
+	}()
+	<-inside
+	if c.TryAtomic(func() {}) {
+		t.Error("TryAtomic executed the commiter while a transaction was running")
+	}
+	close(done)
+	<-finished
+	if x != 2 {
+		t.Errorf("x is %d instead of 2", x)
+	}
+	if stats := c.Stats(); stats.Aborts != 0 {
+		t.Errorf("The failed TryAtomic caused %d aborts", stats.Aborts)
+	}
+}
+
+// TestSoftRTMContextMixed updates the same words from speculative
+// transactions and from irrevocable commiters using plain memory accesses,
+// which must never overlap, also according to the race detector.
+func TestSoftRTMContextMixed(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const arrayLength = 16
+	const numIterations = 50000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	var wg sync.WaitGroup
+	var arr = make([]uint64, arrayLength)
+	var c = NewSoftRTMContext()
+
+	wg.Add(numConcurGoRoutines)
+	for g := 0; g < numConcurGoRoutines; g++ {
+		go func(g int) {
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < numIterations; i++ {
+				index := r.Intn(arrayLength)
+				switch g % 3 {
+				case 0:
+					c.AtomicTx(func(tx *Tx) {
+						tx.Store(&arr[index], tx.Load(&arr[index])+1)
+					})
+				case 1:
+					c.Atomic(func() {
+						arr[index]++
+					})
+				default:
+					if !c.TryAtomic(func() {
+						arr[index]++
+					}) {
+						c.AtomicTx(func(tx *Tx) {
+							tx.Store(&arr[index], tx.Load(&arr[index])+1)
+						})
+					}
+				}
+			}
+			wg.Done()
+		}(g)
+	}
+	wg.Wait()
+
+	var sum uint64
+	for _, v := range arr {
+		sum += v
+	}
+	if expected := uint64(numIterations * numConcurGoRoutines); sum != expected {
+		t.Fatalf("Sum result is %d, but we expected %d", sum, expected)
+	}
+}
@@ -0,0 +1,152 @@
+package safetyfast
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// ticketBackoff is the number of PAUSE instructions a waiting ticket spins
+// for each ticket ahead of it, before reading the owner again. Waiters far
+// back in the queue poll less often, which reduces the traffic on the lock's
+// cache line while the next waiters are handed the lock.
+const ticketBackoff = 16
+
+// ticketWait spins until the owner read from val, masked by mask, equals
+// ticket. The spin backs off in proportion to the distance to the owner, and
+// invokes the scheduler after every LockAttempts pauses, so that a waiter
+// whose turn has come is not kept from running. The ticket is kept while
+// yielding, so waiters are still served in FIFO order.
+func ticketWait(val *uint32, mask, ticket uint32) {
+	var paused uint32
+	for {
+		distance := (ticket - atomic.LoadUint32(val)) & mask
+		if distance == 0 {
+			return
+		}
+		for i := distance * ticketBackoff; i > 0; i-- {
+			Pause()
+		}
+		if paused += distance * ticketBackoff; paused >= uint32(LockAttempts) {
+			paused = 0
+			// Invoke scheduler to allow the owner to run
+			runtime.Gosched()
+		}
+	}
+}
+
+// SpinTicketMutex is a fair sync.Mutex replacement.
+// Each Lock takes a ticket using LOCK XADD and waits until all earlier
+// tickets released the lock, so waiters acquire the lock in the order they
+// called Lock and can not starve, unlike with the test-and-set spin locks.
+// Waiting is proportional to the distance to the current ticket.
+//
+// Since every waiter must run in turn, a descheduled waiter delays all
+// waiters behind it. SpinTicketMutex should be used where fairness matters
+// more than throughput, and with GOMAXPROCS no larger than the number of
+// CPUs, since yielding can not run a waiter whose thread the OS preempted.
+type SpinTicketMutex struct {
+	// next is the ticket handed out to the next Lock
+	next uint32
+	// owner is the ticket that holds the lock
+	owner uint32
+}
+
+func (m *SpinTicketMutex) Lock() {
+	ticket := atomic.AddUint32(&m.next, 1) - 1
+	ticketWait(&m.owner, ^uint32(0), ticket)
+}
+
+// TryLock acquires the lock only if no other ticket holds or waits for it,
+// and reports if it succeeded.
+func (m *SpinTicketMutex) TryLock() bool {
+	next := atomic.LoadUint32(&m.next)
+	return atomic.LoadUint32(&m.owner) == next &&
+		atomic.CompareAndSwapUint32(&m.next, next, next+1)
+}
+
+// LockTimeout acquires the lock, unless it could not be acquired within d.
+// It reports if the lock was acquired.
+// The lock is only acquired while it is free, so unlike Lock, LockTimeout
+// does not wait in line and may wait longer than later calls to Lock.
+func (m *SpinTicketMutex) LockTimeout(d time.Duration) bool {
+	return lockTimeout(func() bool {
+		return tryLockRound(m.TryLock)
+	}, d)
+}
+
+// LockContext acquires the lock, unless ctx is done first, in which case
+// it returns the context's error.
+// The lock is only acquired while it is free, so unlike Lock, LockContext
+// does not wait in line and may wait longer than later calls to Lock.
+func (m *SpinTicketMutex) LockContext(ctx context.Context) error {
+	return lockContext(func() bool {
+		return tryLockRound(m.TryLock)
+	}, ctx)
+}
+
+func (m *SpinTicketMutex) Unlock() {
+	// Only the owner writes owner, but waiters read it concurrently
+	atomic.StoreUint32(&m.owner, m.owner+1)
+}
+
+// IsLocked reports if the lock is held.
+func (m *SpinTicketMutex) IsLocked() bool {
+	return atomic.LoadUint32(&m.owner) != atomic.LoadUint32(&m.next)
+}
+
+// SpinHLETicketMutex is a fair sync.Mutex replacement that uses HLE.
+// It behaves like SpinTicketMutex, but the next ticket and the owner share
+// a single word, using 16 bits each. The ticket is taken using
+// XACQUIRE LOCK XADD, and when no other ticket was taken while the lock was
+// held, Unlock restores the word using XRELEASE LOCK CMPXCHG, so that
+// uncontended critical sections are elided and run concurrently.
+// At most 65535 goroutines may wait for the lock at the same time.
+type SpinHLETicketMutex uint32
+
+func (m *SpinHLETicketMutex) Lock() {
+	old := HLETicketAcquire((*uint32)(m))
+	ticketWait((*uint32)(m), 0xffff, old>>16)
+}
+
+// TryLock acquires the lock only if no other ticket holds or waits for it,
+// and reports if it succeeded. The lock is not elided.
+func (m *SpinHLETicketMutex) TryLock() bool {
+	old := atomic.LoadUint32((*uint32)(m))
+	return old>>16 == old&0xffff &&
+		atomic.CompareAndSwapUint32((*uint32)(m), old, old+1<<16)
+}
+
+// LockTimeout acquires the lock, unless it could not be acquired within d.
+// It reports if the lock was acquired. The lock is not elided.
+// The lock is only acquired while it is free, so unlike Lock, LockTimeout
+// does not wait in line and may wait longer than later calls to Lock.
+func (m *SpinHLETicketMutex) LockTimeout(d time.Duration) bool {
+	return lockTimeout(func() bool {
+		return tryLockRound(m.TryLock)
+	}, d)
+}
+
+// LockContext acquires the lock, unless ctx is done first, in which case
+// it returns the context's error. The lock is not elided.
+// The lock is only acquired while it is free, so unlike Lock, LockContext
+// does not wait in line and may wait longer than later calls to Lock.
+func (m *SpinHLETicketMutex) LockContext(ctx context.Context) error {
+	return lockContext(func() bool {
+		return tryLockRound(m.TryLock)
+	}, ctx)
+}
+
+func (m *SpinHLETicketMutex) Unlock() {
+	// The owner is the ticket that holds the lock. Within an elided section,
+	// the word reads as modified by this thread's HLETicketAcquire.
+	HLETicketRelease((*uint32)(m), atomic.LoadUint32((*uint32)(m))&0xffff)
+}
+
+// IsLocked reports if the lock is held.
+// When the lock has been elided by HLE, it appears free to other threads.
+func (m *SpinHLETicketMutex) IsLocked() bool {
+	old := atomic.LoadUint32((*uint32)(m))
+	return old>>16 != old&0xffff
+}
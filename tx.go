@@ -0,0 +1,87 @@
+package safetyfast
+
+// Tx is a handle given to a commiter launched using AtomicTx.
+// It allows the commiter to find out how it is being executed, to
+// abort the transaction it is running in, and to access words
+// transactionally.
+// A Tx must not be used after the commiter returns.
+type Tx struct {
+	attempt  int
+	fallback bool
+	// soft is the software transaction, when launched from a SoftRTMContext
+	soft *softTx
+	// simulated is set within a transaction simulated by the tests
+	simulated bool
+}
+
+// InTransaction reports if the commiter is running within a transaction.
+// For hardware transactions, it is backed by the XTEST instruction.
+// If it returns false, the commiter is running on the fallback path.
+func (tx *Tx) InTransaction() bool {
+	if tx.fallback {
+		return false
+	}
+	if tx.soft != nil || tx.simulated {
+		return true
+	}
+	return xtest()
+}
+
+// Load reads the word at addr as part of the transaction.
+// Within a hardware transaction or on the fallback path, this is a plain
+// read. Within a SoftRTMContext transaction, the word is added to the
+// transaction's read set.
+func (tx *Tx) Load(addr *uint64) uint64 {
+	if tx.soft != nil {
+		return tx.soft.load(addr)
+	}
+	return *addr
+}
+
+// Store writes val to the word at addr as part of the transaction.
+// Within a hardware transaction or on the fallback path, this is a plain
+// write. Within a SoftRTMContext transaction, the write is buffered until
+// the transaction commits.
+func (tx *Tx) Store(addr *uint64, val uint64) {
+	if tx.soft != nil {
+		tx.soft.store(addr, val)
+		return
+	}
+	*addr = val
+}
+
+// Abort aborts the transaction the commiter is running in, using code as the
+// explicit abort code. The abort is then handled according to the context's
+// retry policy, which by default will run the commiter on the fallback path.
+// Abort does not return when running within a transaction.
+// When the commiter is running on the fallback path, Abort has no effect and
+// returns, so the commiter must be prepared to continue.
+// The code 0xFF is reserved for aborts caused by the fallback lock being held.
+func (tx *Tx) Abort(code uint8) {
+	if tx.fallback {
+		return
+	}
+	if tx.soft != nil {
+		tx.soft.abort(AbortExplicit | uint32(code)<<24)
+	}
+	if tx.simulated {
+		panic(softAbort(AbortExplicit | uint32(code)<<24))
+	}
+	xabort(code)
+}
+
+// Attempt returns the number of attempts that preceded this execution of
+// the commiter, which is 0 on the first attempt.
+func (tx *Tx) Attempt() int {
+	return tx.attempt
+}
+
+// AtomicTx executes commiter atomically with respect to other commiters
+// launched from this context. The commiter is always run with the lock held,
+// so tx.InTransaction always reports false.
+func (c *LockedContext) AtomicTx(commiter func(tx *Tx)) {
+	tx := Tx{fallback: true}
+	c.lock.Lock()
+	commiter(&tx)
+	c.lock.Unlock()
+}
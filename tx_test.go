@@ -0,0 +1,61 @@
+package safetyfast
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAtomicTx(t *testing.T) {
+	type txContext interface {
+		AtomicTx(commiter func(tx *Tx))
+	}
+
+	run := func(t *testing.T, c txContext, transactional bool) {
+		var x int
+		c.AtomicTx(func(tx *Tx) {
+			if !transactional && tx.InTransaction() {
+				t.Error("InTransaction reported true on the fallback path")
+			}
+			x++
+		})
+		if x != 1 {
+			t.Errorf("x is %d instead of 1", x)
+		}
+
+		// Aborting must land on the fallback path, where the abort is
+		// ignored
+		var fallbacks int
+		c.AtomicTx(func(tx *Tx) {
+			tx.Abort(1)
+			if tx.InTransaction() {
+				t.Error("InTransaction reported true after an abort")
+			}
+			if transactional && tx.Attempt() == 0 {
+				t.Error("Attempt reported 0 after an abort")
+			}
+			fallbacks++
+			x++
+		})
+		if fallbacks != 1 {
+			t.Errorf("The commiter ran %d times on the fallback path instead of once", fallbacks)
+		}
+		if x != 2 {
+			t.Errorf("x is %d instead of 2", x)
+		}
+	}
+
+	t.Run("LockedContext", func(t *testing.T) {
+		run(t, NewLockedContext(new(sync.Mutex)), false)
+	})
+
+	t.Run("RTMContext", func(t *testing.T) {
+		if !RTMAvailable() {
+			t.Skip("The CPU does not support Intel RTM - Skipping RTM Test!")
+		}
+		c := NewRTMContexDefault()
+		run(t, c, true)
+		if code := c.Stats().ExplicitCodes[1]; code != 1 {
+			t.Errorf("ExplicitCodes[1] is %d instead of 1", code)
+		}
+	})
+}
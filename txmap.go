@@ -0,0 +1,399 @@
+package safetyfast
+
+import (
+	"hash/maphash"
+	"runtime"
+	"sync/atomic"
+)
+
+// DefaultTxMapShards is the minimum number of shards a TxMap is split into,
+// unless overridden using WithShards.
+const DefaultTxMapShards = 16
+
+// txMapLoadFactor is the fraction of slots, in 1/8ths, that a shard may fill
+// before it reports being full. Linear probing needs free slots to keep
+// probe sequences, and so transaction footprints, short.
+const txMapLoadFactor = 6
+
+// txMapSnapshotAttempts is the number of times Len and Range copy the
+// shards while writers keep running, before writers are made to wait for
+// the copy to complete.
+const txMapSnapshotAttempts = 4
+
+// TxMapOption configures a TxMap.
+type TxMapOption func(c *txMapConfig)
+
+type txMapConfig struct {
+	shards     int
+	newContext func() AtomicContext
+}
+
+// WithShards sets the number of shards a TxMap is split into.
+// Each shard is protected by its own context, so operations on different
+// shards never conflict and never share a fallback lock.
+func WithShards(n int) TxMapOption {
+	return func(c *txMapConfig) {
+		c.shards = n
+	}
+}
+
+// WithContexts sets the function used to create the context that protects
+// each shard of a TxMap. By default, NewAutoContext is used.
+func WithContexts(newContext func() AtomicContext) TxMapOption {
+	return func(c *txMapConfig) {
+		c.newContext = newContext
+	}
+}
+
+// txMapSlot is a single entry of a shard's open addressing table.
+type txMapSlot[K comparable, V any] struct {
+	hash uint64
+	used bool
+	key  K
+	val  V
+}
+
+// txMapShard is a fixed capacity hash table protected by its own context.
+type txMapShard[K comparable, V any] struct {
+	ctx AtomicContext
+	// rctx is set if ctx is also an RWAtomicContext
+	rctx  RWAtomicContext
+	slots []txMapSlot[K, V]
+	mask  uint64
+	count int
+	limit int
+	// version is incremented by every operation that modifies the shard
+	version uint64
+	// Keep the count of neighboring shards out of this shard's cache lines,
+	// so that transactions on different shards do not conflict
+	_ [128]byte
+}
+
+// TxMap is a hash map that is safe for concurrent use, whose operations are
+// executed as transactions.
+//
+// Unlike a Go map, a TxMap never grows. All of its memory is allocated when
+// it is created, so operations never allocate within a transaction, which
+// would always cause an RTM abort. Entries are spread over several shards,
+// each protected by its own context, so that transactions on different
+// shards do not conflict and fallbacks on one shard do not serialize the
+// others.
+type TxMap[K comparable, V any] struct {
+	shards   []txMapShard[K, V]
+	hash     func(K) uint64
+	capacity int
+	// snapshots is the number of snapshots that writers must wait for
+	snapshots int32
+}
+
+// NewTxMap creates a TxMap that can hold at least capacity entries.
+// Keys are spread over the shards using hash, which must return the same
+// value for equal keys. HashString and HashUint64 are suitable for string
+// and integer keys.
+// Since hash values are not perfectly uniform, the shards are sized with
+// some headroom, but Set may still report a full shard before the map holds
+// capacity entries.
+func NewTxMap[K comparable, V any](capacity int, hash func(K) uint64, opts ...TxMapOption) *TxMap[K, V] {
+	cfg := txMapConfig{
+		shards:     DefaultTxMapShards,
+		newContext: NewAutoContext,
+	}
+	if procs := runtime.GOMAXPROCS(0) * 4; procs > cfg.shards {
+		cfg.shards = procs
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.shards < 1 {
+		cfg.shards = 1
+	}
+
+	// Give each shard room for half more than its even share, plus a few
+	// entries, since small shares vary the most
+	perShard := (capacity + cfg.shards - 1) / cfg.shards
+	perShard += perShard/2 + 8
+	slots := 1
+	for slots*txMapLoadFactor/8 < perShard {
+		slots <<= 1
+	}
+
+	m := &TxMap[K, V]{
+		shards:   make([]txMapShard[K, V], cfg.shards),
+		hash:     hash,
+		capacity: cfg.shards * perShard,
+	}
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.ctx = cfg.newContext()
+		s.rctx, _ = s.ctx.(RWAtomicContext)
+		s.slots = make([]txMapSlot[K, V], slots)
+		s.mask = uint64(slots - 1)
+		s.limit = perShard
+	}
+	return m
+}
+
+// shard returns the shard that holds keys with hash value h.
+// The upper bits select the shard, since the lower bits select the slot.
+func (m *TxMap[K, V]) shard(h uint64) *txMapShard[K, V] {
+	return &m.shards[(h>>32)%uint64(len(m.shards))]
+}
+
+// waitSnapshots waits while a snapshot of all shards holds off writers.
+func (m *TxMap[K, V]) waitSnapshots() {
+	for atomic.LoadInt32(&m.snapshots) != 0 {
+		runtime.Gosched()
+	}
+}
+
+// read executes reader atomically using the shard's context, with the read
+// lock if the context supports it.
+func (s *txMapShard[K, V]) read(reader func()) {
+	if s.rctx != nil {
+		s.rctx.AtomicRead(reader)
+		return
+	}
+	s.ctx.Atomic(reader)
+}
+
+// find returns the slot that holds k, or the free slot where k would be
+// inserted, and reports if k was found.
+func (s *txMapShard[K, V]) find(k K, h uint64) (uint64, bool) {
+	i := h & s.mask
+	for {
+		slot := &s.slots[i]
+		if !slot.used {
+			return i, false
+		}
+		if slot.hash == h && slot.key == k {
+			return i, true
+		}
+		i = (i + 1) & s.mask
+	}
+}
+
+// insert places k in the free slot i, and reports if the shard had room.
+func (s *txMapShard[K, V]) insert(i uint64, k K, h uint64) bool {
+	if s.count >= s.limit {
+		return false
+	}
+	slot := &s.slots[i]
+	slot.hash = h
+	slot.used = true
+	slot.key = k
+	s.count++
+	return true
+}
+
+// remove empties slot i, shifting back any later entries of the same probe
+// sequence, so that lookups never need to skip over deleted slots.
+func (s *txMapShard[K, V]) remove(i uint64) {
+	for {
+		s.slots[i] = txMapSlot[K, V]{}
+		j := i
+		for {
+			j = (j + 1) & s.mask
+			if !s.slots[j].used {
+				s.count--
+				return
+			}
+			// The entry at j can only move to i, if i lies cyclically
+			// between its home slot and j
+			home := s.slots[j].hash & s.mask
+			if (j > i && (home <= i || home > j)) || (j < i && home <= i && home > j) {
+				s.slots[i] = s.slots[j]
+				i = j
+				break
+			}
+		}
+	}
+}
+
+// Get returns the value stored for k, and reports if k was present.
+func (m *TxMap[K, V]) Get(k K) (V, bool) {
+	h := m.hash(k)
+	s := m.shard(h)
+	var val V
+	var ok bool
+	s.read(func() {
+		var i uint64
+		if i, ok = s.find(k, h); ok {
+			val = s.slots[i].val
+		}
+	})
+	return val, ok
+}
+
+// Set stores val for k. It reports false if k was not present and the
+// shard that would hold k is full, in which case the map is unchanged.
+func (m *TxMap[K, V]) Set(k K, val V) bool {
+	h := m.hash(k)
+	s := m.shard(h)
+	ok := true
+	m.waitSnapshots()
+	s.ctx.Atomic(func() {
+		i, found := s.find(k, h)
+		if !found && !s.insert(i, k, h) {
+			ok = false
+			return
+		}
+		s.slots[i].val = val
+		s.version++
+	})
+	return ok
+}
+
+// Update calls fn with a pointer to the value stored for k, within a single
+// transaction. If k was not present, it is inserted with the zero value
+// before fn is called. It reports false if k was not present and the shard
+// that would hold k is full, in which case fn is not called.
+// The pointer must not be retained after fn returns. Since fn runs within
+// the transaction, it should be short and must not allocate memory.
+func (m *TxMap[K, V]) Update(k K, fn func(val *V)) bool {
+	h := m.hash(k)
+	s := m.shard(h)
+	ok := true
+	m.waitSnapshots()
+	s.ctx.Atomic(func() {
+		i, found := s.find(k, h)
+		if !found && !s.insert(i, k, h) {
+			ok = false
+			return
+		}
+		fn(&s.slots[i].val)
+		s.version++
+	})
+	return ok
+}
+
+// Delete removes k from the map, and reports if k was present.
+func (m *TxMap[K, V]) Delete(k K) bool {
+	h := m.hash(k)
+	s := m.shard(h)
+	var found bool
+	m.waitSnapshots()
+	s.ctx.Atomic(func() {
+		var i uint64
+		if i, found = s.find(k, h); found {
+			s.remove(i)
+			s.version++
+		}
+	})
+	return found
+}
+
+// readShards calls reader with each shard, within the shard's own read
+// section, until it has read all shards as they were at a single point in
+// time. Transactions are never nested, since nesting a transaction per
+// shard would exceed the nesting depth of RTM.
+//
+// After reading all shards, the version of each shard is checked again. If
+// no shard changed since it was read, all shards were in the state read
+// right after the last one was read. Otherwise all shards are read again,
+// so reader must overwrite the results of earlier calls for the same
+// shard. If the shards keep changing, writers are made to wait, so that
+// the snapshot can not be starved.
+func (m *TxMap[K, V]) readShards(reader func(i int, s *txMapShard[K, V])) {
+	versions := make([]uint64, len(m.shards))
+	for attempt := 1; ; attempt++ {
+		if attempt == txMapSnapshotAttempts {
+			atomic.AddInt32(&m.snapshots, 1)
+			defer atomic.AddInt32(&m.snapshots, -1)
+		}
+		for i := range m.shards {
+			i, s := i, &m.shards[i]
+			s.read(func() {
+				versions[i] = s.version
+				reader(i, s)
+			})
+		}
+		if m.unchanged(versions) {
+			return
+		}
+	}
+}
+
+// unchanged reports if no shard changed since its version was read.
+func (m *TxMap[K, V]) unchanged(versions []uint64) bool {
+	for i := range m.shards {
+		i, s := i, &m.shards[i]
+		var same bool
+		s.read(func() {
+			same = s.version == versions[i]
+		})
+		if !same {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of entries in the map.
+func (m *TxMap[K, V]) Len() int {
+	counts := make([]int, len(m.shards))
+	m.readShards(func(i int, s *txMapShard[K, V]) {
+		counts[i] = s.count
+	})
+	var n int
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+// Range calls fn for each entry in the map, until fn returns false.
+// The entries are taken from a consistent snapshot of the whole map, which
+// is copied one shard at a time and taken again if a shard changed while it
+// was copied. Since fn is called on the snapshot after it is taken, fn may
+// modify the map.
+func (m *TxMap[K, V]) Range(fn func(k K, val V) bool) {
+	// Allocate the snapshot up front, so that taking it does not allocate
+	// within a transaction
+	keys := make([]K, 0, m.capacity)
+	vals := make([]V, 0, m.capacity)
+	// ends holds the end of each shard's entries within keys and vals
+	ends := make([]int, len(m.shards))
+	m.readShards(func(i int, s *txMapShard[K, V]) {
+		// Drop the entries of this and later shards from a previous read
+		var start int
+		if i > 0 {
+			start = ends[i-1]
+		}
+		keys, vals = keys[:start], vals[:start]
+		for j := range s.slots {
+			if slot := &s.slots[j]; slot.used {
+				keys = append(keys, slot.key)
+				vals = append(vals, slot.val)
+			}
+		}
+		ends[i] = len(keys)
+	})
+	for i := range keys {
+		if !fn(keys[i], vals[i]) {
+			return
+		}
+	}
+}
+
+// hashSeed seeds HashString, so that hash values differ between processes.
+var hashSeed = maphash.MakeSeed()
+
+// HashString hashes s for use as a TxMap hash function.
+func HashString(s string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(hashSeed)
+	h.WriteString(s)
+	return h.Sum64()
+}
+
+// HashUint64 mixes the bits of x for use as a TxMap hash function, so that
+// sequential integer keys spread over both the shards and the slots.
+// It is the finalizer of the SplitMix64 generator.
+func HashUint64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
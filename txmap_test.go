@@ -0,0 +1,324 @@
+package safetyfast
+
+import (
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func hashInt(k int) uint64 {
+	return HashUint64(uint64(k))
+}
+
+func TestTxMap(t *testing.T) {
+	m := NewTxMap[string, int](100, HashString, WithShards(4))
+
+	if _, ok := m.Get("word1"); ok {
+		t.Error("Get found a key in an empty map")
+	}
+	if !m.Set("word1", 1) {
+		t.Fatal("Set failed on an empty map")
+	}
+	if v, ok := m.Get("word1"); !ok || v != 1 {
+		t.Errorf("Get returned %v, %v instead of 1, true", v, ok)
+	}
+	m.Update("word1", func(v *int) { *v += 2 })
+	m.Update("word2", func(v *int) { *v += 5 })
+	if v, _ := m.Get("word1"); v != 3 {
+		t.Errorf("Update set word1 to %v instead of 3", v)
+	}
+	if v, _ := m.Get("word2"); v != 5 {
+		t.Errorf("Update set word2 to %v instead of 5", v)
+	}
+	if n := m.Len(); n != 2 {
+		t.Errorf("Len returned %d instead of 2", n)
+	}
+	if !m.Delete("word1") {
+		t.Error("Delete did not find word1")
+	}
+	if m.Delete("word1") {
+		t.Error("Delete found word1 twice")
+	}
+	if _, ok := m.Get("word1"); ok {
+		t.Error("Get found a deleted key")
+	}
+	if n := m.Len(); n != 1 {
+		t.Errorf("Len returned %d instead of 1", n)
+	}
+}
+
+func TestTxMapFull(t *testing.T) {
+	const capacity = 64
+	m := NewTxMap[int, int](capacity, hashInt, WithShards(1))
+
+	var inserted int
+	for i := 0; m.Set(i, i); i++ {
+		inserted++
+	}
+	if inserted < capacity {
+		t.Fatalf("Set reported a full map after %d entries instead of at least %d", inserted, capacity)
+	}
+	if m.Update(-1, func(v *int) { t.Error("Update called fn on a full map") }) {
+		t.Error("Update inserted into a full map")
+	}
+	// Existing keys can still be changed
+	if !m.Set(0, 100) {
+		t.Error("Set failed to change an existing key in a full map")
+	}
+	if n := m.Len(); n != inserted {
+		t.Errorf("Len returned %d instead of %d", n, inserted)
+	}
+}
+
+// TestTxMapRandom checks a TxMap against a Go map, under a random mix of
+// operations that exercises probe sequences and deletions.
+func TestTxMapRandom(t *testing.T) {
+	m := NewTxMap[int, int](256, hashInt, WithShards(2))
+	expected := make(map[int]int)
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 100000; i++ {
+		k := r.Intn(300)
+		switch r.Intn(3) {
+		case 0:
+			if m.Set(k, i) {
+				expected[k] = i
+			} else if _, ok := expected[k]; ok {
+				t.Fatalf("Set failed to change existing key %d", k)
+			}
+		case 1:
+			_, ok := expected[k]
+			if m.Delete(k) != ok {
+				t.Fatalf("Delete(%d) did not report %v", k, ok)
+			}
+			delete(expected, k)
+		case 2:
+			v, ok := m.Get(k)
+			if ev, eok := expected[k]; v != ev || ok != eok {
+				t.Fatalf("Get(%d) returned %v, %v instead of %v, %v", k, v, ok, ev, eok)
+			}
+		}
+	}
+
+	var count int
+	m.Range(func(k, v int) bool {
+		count++
+		if ev, ok := expected[k]; !ok || v != ev {
+			t.Errorf("Range returned %d: %d, but expected has %d, %v", k, v, ev, ok)
+		}
+		return true
+	})
+	if count != len(expected) {
+		t.Errorf("Range returned %d entries instead of %d", count, len(expected))
+	}
+}
+
+func TestTxMapConcurrent(t *testing.T) {
+	const numConcurGoRoutines = 8
+	const numKeys = 100
+	const numIterations = 200000 / raceScale
+
+	oldmaxprocs := runtime.GOMAXPROCS(numConcurGoRoutines)
+	defer runtime.GOMAXPROCS(oldmaxprocs)
+
+	run := func(t *testing.T, m *TxMap[string, int]) {
+		keys := make([]string, numKeys)
+		for i := range keys {
+			keys[i] = "key" + strconv.Itoa(i)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(numConcurGoRoutines)
+		for g := 0; g < numConcurGoRoutines; g++ {
+			go func(seed int64) {
+				r := rand.New(rand.NewSource(seed))
+				for i := 0; i < numIterations; i++ {
+					if !m.Update(keys[r.Intn(numKeys)], func(v *int) {
+						*v++
+					}) {
+						t.Error("Update reported a full map")
+						break
+					}
+				}
+				wg.Done()
+			}(int64(g))
+		}
+		wg.Wait()
+
+		var sum int
+		m.Range(func(k string, v int) bool {
+			sum += v
+			return true
+		})
+		if expected := numConcurGoRoutines * numIterations; sum != expected {
+			t.Fatalf("Sum result is %d, but we expected %d", sum, expected)
+		}
+	}
+
+	t.Run("AutoContext", func(t *testing.T) {
+		run(t, NewTxMap[string, int](numKeys, HashString))
+	})
+
+	t.Run("sync.RWMutex", func(t *testing.T) {
+		run(t, NewTxMap[string, int](numKeys, HashString, WithContexts(func() AtomicContext {
+			return NewLockedContext(new(sync.RWMutex))
+		})))
+	})
+
+	t.Run("Faults", func(t *testing.T) {
+		run(t, NewTxMap[string, int](numKeys, HashString, WithContexts(func() AtomicContext {
+			return newRTMContextFaults(new(SpinMutex), faultSequence(AbortConflict))
+		})))
+	})
+}
+
+// TestTxMapRangeConsistent increments a key on a late shard and then a key
+// on an early shard, while checking that every Range snapshot sees them at
+// most one increment apart. A snapshot that read the shards one at a time
+// could see the late key far ahead of the early key.
+func TestTxMapRangeConsistent(t *testing.T) {
+	const numShards = 8
+	const numIterations = 100000 / raceScale
+
+	m := NewTxMap[int, int](16, hashInt, WithShards(numShards))
+	shardOf := func(k int) uint64 {
+		return (hashInt(k) >> 32) % numShards
+	}
+	early, late := 0, 1
+	for shardOf(late) <= shardOf(early) {
+		late++
+	}
+	m.Set(early, 0)
+	m.Set(late, 0)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < numIterations; i++ {
+			m.Update(late, func(v *int) { *v++ })
+			m.Update(early, func(v *int) { *v++ })
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		var e, l int
+		m.Range(func(k, v int) bool {
+			switch k {
+			case early:
+				e = v
+			case late:
+				l = v
+			}
+			return true
+		})
+		if l != e && l != e+1 {
+			t.Fatalf("Range snapshot saw late=%d and early=%d", l, e)
+		}
+	}
+}
+
+// depthContext is an RWAtomicContext that records how deeply atomic
+// sections of all depthContexts sharing depth are nested.
+type depthContext struct {
+	*LockedContext
+	depth, maxDepth *int
+}
+
+func (c depthContext) enter() {
+	*c.depth++
+	if *c.depth > *c.maxDepth {
+		*c.maxDepth = *c.depth
+	}
+}
+
+func (c depthContext) Atomic(commiter func()) {
+	c.LockedContext.Atomic(func() {
+		c.enter()
+		commiter()
+		*c.depth--
+	})
+}
+
+func (c depthContext) AtomicRead(reader func()) {
+	c.LockedContext.AtomicRead(func() {
+		c.enter()
+		reader()
+		*c.depth--
+	})
+}
+
+func TestTxMapSnapshotNotNested(t *testing.T) {
+	var depth, maxDepth int
+	m := NewTxMap[int, int](64, hashInt, WithShards(32), WithContexts(func() AtomicContext {
+		return depthContext{NewLockedContext(new(SpinMutex)), &depth, &maxDepth}
+	}))
+	for k := 0; k < 32; k++ {
+		m.Set(k, k)
+	}
+	if n := m.Len(); n != 32 {
+		t.Errorf("Len returned %d instead of 32", n)
+	}
+	var count int
+	m.Range(func(k, v int) bool {
+		count++
+		return true
+	})
+	if count != 32 {
+		t.Errorf("Range returned %d entries instead of 32", count)
+	}
+	if maxDepth != 1 {
+		t.Errorf("Atomic sections were nested %d deep", maxDepth)
+	}
+}
+
+func TestTxMapSnapshotRTMStats(t *testing.T) {
+	if !RTMAvailable() {
+		t.Skip("The CPU does not support Intel RTM - Skipping RTM Test!")
+	}
+	const numSnapshots = 1000
+
+	var contexts []*RTMContext
+	m := NewTxMap[int, int](256, hashInt, WithContexts(func() AtomicContext {
+		c := NewRTMContex(new(SpinMutex))
+		contexts = append(contexts, c)
+		return c
+	}))
+	for k := 0; k < 256; k++ {
+		m.Set(k, k)
+	}
+	for _, c := range contexts {
+		c.Reset()
+	}
+
+	for i := 0; i < numSnapshots; i++ {
+		m.Len()
+		m.Range(func(k, v int) bool {
+			return true
+		})
+	}
+
+	var stats RTMStats
+	for _, c := range contexts {
+		s := c.Stats()
+		stats.Commits += s.Commits
+		stats.Aborts += s.Aborts
+		stats.Fallbacks += s.Fallbacks
+		stats.Nested += s.Nested
+		stats.Capacity += s.Capacity
+	}
+	t.Logf("Commits=%d | Aborts=%d | Fallbacks=%d", stats.Commits, stats.Aborts, stats.Fallbacks)
+	if stats.Nested != 0 || stats.Capacity != 0 {
+		t.Errorf("Snapshots caused %d nested and %d capacity aborts", stats.Nested, stats.Capacity)
+	}
+	// Interrupts may still abort a few transactions
+	if stats.Aborts > stats.Commits/100 {
+		t.Errorf("Snapshots caused %d aborts in %d commits", stats.Aborts, stats.Commits)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build (!386 && !amd64) || race
+// +build !386,!amd64 race
+
+package safetyfast
+
+import "sync/atomic"
+
+// unlock32 writes a 0 to val in order to release a lock.
+// Weakly ordered architectures need a store-release, so that writes made
+// while holding the lock are visible before the lock appears free.
+func unlock32(val *int32) {
+	atomic.StoreInt32(val, 0)
+}